@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"hive/pkg/uhp"
+	"os"
+)
+
+const usage = `Использование: hive <команда>
+
+Команды:
+  uhp     движок Universal Hive Protocol на стандартных потоках ввода-вывода
+  server  игровой сервер: hive server [-addr адрес] [-expansions MLP] [-records каталог]
+          [-max-illegal-moves N] [-reconnect-grace 30s]
+  perft   подсчёт числа позиций дерева ходов: hive perft [-divide] <глубина> [строка партии]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "uhp":
+		err = uhp.NewServer(os.Stdin, os.Stdout).Serve()
+	case "server":
+		err = serve(os.Args[2:])
+	case "perft":
+		err = perft(os.Args[2:], os.Stdout)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
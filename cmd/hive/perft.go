@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hive/pkg/notation"
+	"io"
+	"strconv"
+	"time"
+)
+
+// perft считает листья дерева ходов для глубин от 1 до заданной.
+// С флагом -divide для последней глубины печатается разбивка по первым ходам.
+func perft(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("perft", flag.ContinueOnError)
+	divide := flags.Bool("divide", false, "разбить результат последней глубины по первым ходам")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("использование: hive perft [-divide] <глубина> [строка партии]")
+	}
+	depth, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || depth < 1 {
+		return fmt.Errorf("некорректная глубина %q", flags.Arg(0))
+	}
+	gameString := "Base"
+	if flags.NArg() == 2 {
+		gameString = flags.Arg(1)
+	}
+
+	session, _, err := notation.ParseGameString(gameString)
+	if err != nil {
+		return err
+	}
+
+	for d := 1; d <= depth; d++ {
+		start := time.Now()
+		nodes := session.Perft(d)
+		fmt.Fprintf(out, "perft(%d) = %d\t%v\n", d, nodes, time.Since(start).Round(time.Millisecond))
+	}
+
+	if *divide {
+		for _, move := range session.LegalMoves() {
+			move := move
+			formatted, err := notation.FormatMove(session, &move)
+			if err != nil {
+				return err
+			}
+			if err = session.ApplyMove(&move); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s\t%d\n", formatted, session.Perft(depth-1))
+			if err = session.Undo(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
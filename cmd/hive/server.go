@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"hive/pkg/server"
+	"os"
+	"os/signal"
+
+	"go.uber.org/zap"
+)
+
+// serve запускает игровой сервер и работает до прерывания процесса.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	endpoint := flags.String("addr", "127.0.0.1:8080", "адрес, на котором сервер принимает игроков")
+	expansions := flags.String("expansions", "", "расширения новых партий, например MLP")
+	records := flags.String("records", "", "каталог для записей завершённых партий")
+	maxIllegalMoves := flags.Int("max-illegal-moves", server.DefaultMaxIllegalMoves, "недопустимых ходов подряд до поражения, 0 — без ограничения")
+	grace := flags.Duration("reconnect-grace", server.DefaultReconnectGrace, "сколько партия ждёт переподключения игрока")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("использование: hive server [-addr адрес] [-expansions MLP] [-records каталог] [-max-illegal-moves N] [-reconnect-grace 30s]")
+	}
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer log.Sync()
+
+	s := server.NewServer(log, *endpoint)
+	if err := s.SetExpansions(*expansions); err != nil {
+		return err
+	}
+	s.SetRecordDir(*records)
+	s.SetMaxIllegalMoves(*maxIllegalMoves)
+	s.SetReconnectGrace(*grace)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
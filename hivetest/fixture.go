@@ -89,7 +89,7 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 	env.Ctx, cancelRootContext = context.WithCancel(context.Background())
 
 	env.Server = server.NewServer(env.Logger.Named("server"), serverEndpoint)
-	env.Server.Start(env.Ctx)
+	require.NoError(t, env.Server.Start(env.Ctx))
 
 	env.Clients = []*client.Client{
 		client.NewClient(
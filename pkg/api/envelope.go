@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ProtocolVersion — последняя версия протокола, которую поддерживает пакет.
+// Версия сообщения не может быть выше версии, согласованной при рукопожатии.
+const ProtocolVersion = 1
+
+// SupportedVersions перечисляет версии протокола, с которыми умеет работать пакет.
+var SupportedVersions = []int{1}
+
+// Возможности протокола, о которых стороны договариваются при рукопожатии.
+const (
+	// CapabilityTakeback — игрок отвечает на запросы соперника об отмене хода.
+	CapabilityTakeback = "takeback"
+	// CapabilityMoveRejected — игрок получает сообщения MoveRejected об отклонённых ходах.
+	CapabilityMoveRejected = "move_rejected"
+)
+
+// Capabilities — возможности, которые поддерживает пакет.
+var Capabilities = []string{CapabilityTakeback, CapabilityMoveRejected}
+
+type MessageType string
+
+const (
+	MessageHandshake    MessageType = "handshake"
+	MessageWelcome      MessageType = "welcome"
+	MessagePlayMove     MessageType = "play_move"
+	MessageStatusUpdate MessageType = "status_update"
+	MessageMoveRejected MessageType = "move_rejected"
+	MessageError        MessageType = "error"
+)
+
+var knownMessages = map[MessageType]bool{
+	MessageHandshake:    true,
+	MessageWelcome:      true,
+	MessagePlayMove:     true,
+	MessageStatusUpdate: true,
+	MessageMoveRejected: true,
+	MessageError:        true,
+}
+
+// Envelope — конверт, в котором передаётся каждое сообщение протокола.
+// ID нумерует сообщения отправителя в пределах соединения, на него
+// ссылается ErrorReply.
+type Envelope struct {
+	Type    MessageType     `json:"type"`
+	Version int             `json:"version"`
+	ID      uint64          `json:"id"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Коды ErrorReply.
+const (
+	ErrorUnknownType        = "unknown_type"
+	ErrorUnsupportedType    = "unsupported_type"
+	ErrorUnsupportedVersion = "unsupported_version"
+	ErrorBadPayload         = "bad_payload"
+)
+
+// ErrorReply сообщает отправителю, что его сообщение ReplyTo не обработано.
+type ErrorReply struct {
+	Code    string
+	Message string
+	ReplyTo uint64
+}
+
+func (e *ErrorReply) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Welcome — ответ сервера на рукопожатие: выбранная версия протокола
+// и возможности, которые поддерживают обе стороны.
+type Welcome struct {
+	Version      int
+	Capabilities []string
+}
+
+// wire передаёт сообщения в конвертах поверх соединения: нумерует их,
+// проверяет версию и отвечает ошибкой на сообщения, которые нельзя обработать.
+type wire struct {
+	conn net.Conn
+	// mu сериализует отправку, чтобы номера сообщений шли по порядку
+	mu     sync.Mutex
+	lastID uint64
+	// version и capabilities согласуются при рукопожатии
+	version      int
+	capabilities map[string]bool
+}
+
+func newWire(conn net.Conn) *wire {
+	return &wire{conn: conn, version: ProtocolVersion}
+}
+
+func (w *wire) send(messageType MessageType, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastID += 1
+	return WriteMessage(w.conn, Envelope{Type: messageType, Version: w.version, ID: w.lastID, Payload: data})
+}
+
+// receive читает следующее сообщение одного из типов accepted и разбирает его
+// полезную нагрузку. Сообщения неизвестных и неожиданных типов, сообщения
+// неподдерживаемой версии и с некорректной нагрузкой отклоняются ответом
+// ErrorReply, после чего чтение продолжается. Версия рукопожатия не
+// проверяется: она ещё не согласована. Полученный ErrorReply
+// возвращается как ошибка, если его тип не ожидается.
+func (w *wire) receive(accepted map[MessageType]any) (MessageType, error) {
+	for {
+		var envelope Envelope
+		if err := ReadMessage(w.conn, &envelope); err != nil {
+			return "", err
+		}
+
+		payload, ok := accepted[envelope.Type]
+		switch {
+		case envelope.Type == MessageError && !ok:
+			reply := &ErrorReply{}
+			if err := json.Unmarshal(envelope.Payload, reply); err != nil {
+				return "", err
+			}
+			return "", reply
+		case !knownMessages[envelope.Type]:
+			if err := w.reject(envelope, ErrorUnknownType, fmt.Sprintf("неизвестный тип сообщения %q", envelope.Type)); err != nil {
+				return "", err
+			}
+		case !ok:
+			if err := w.reject(envelope, ErrorUnsupportedType, fmt.Sprintf("сообщение %q здесь не ожидается", envelope.Type)); err != nil {
+				return "", err
+			}
+		case envelope.Type != MessageHandshake && (envelope.Version < 1 || envelope.Version > w.version):
+			if err := w.reject(envelope, ErrorUnsupportedVersion, fmt.Sprintf("версия %d не поддерживается", envelope.Version)); err != nil {
+				return "", err
+			}
+		default:
+			if err := json.Unmarshal(envelope.Payload, payload); err != nil {
+				if err = w.reject(envelope, ErrorBadPayload, err.Error()); err != nil {
+					return "", err
+				}
+				continue
+			}
+			return envelope.Type, nil
+		}
+	}
+}
+
+func (w *wire) reject(envelope Envelope, code, message string) error {
+	return w.send(MessageError, &ErrorReply{Code: code, Message: message, ReplyTo: envelope.ID})
+}
+
+// supports сообщает, согласована ли возможность capability. Игрок без
+// соединения не поддерживает ничего.
+func (w *wire) supports(capability string) bool {
+	return w != nil && w.capabilities[capability]
+}
+
+// negotiate выбирает наибольшую общую версию протокола и общие возможности.
+func (w *wire) negotiate(versions []int, capabilities []string) (*Welcome, bool) {
+	welcome := &Welcome{}
+	for _, version := range versions {
+		for _, supported := range SupportedVersions {
+			if version == supported && version > welcome.Version {
+				welcome.Version = version
+			}
+		}
+	}
+	if welcome.Version == 0 {
+		return nil, false
+	}
+
+	w.version = welcome.Version
+	w.capabilities = map[string]bool{}
+	for _, capability := range capabilities {
+		for _, supported := range Capabilities {
+			if capability == supported && !w.capabilities[capability] {
+				w.capabilities[capability] = true
+				welcome.Capabilities = append(welcome.Capabilities, capability)
+			}
+		}
+	}
+	return welcome, true
+}
+
+// accept запоминает версию и возможности, выбранные сервером.
+func (w *wire) accept(welcome *Welcome) {
+	w.version = welcome.Version
+	w.capabilities = map[string]bool{}
+	for _, capability := range welcome.Capabilities {
+		w.capabilities[capability] = true
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"hive/pkg/game"
+	"net"
+	"testing"
+)
+
+func TestErrorReplies(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sent := moves(1)[0]
+	payload, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		envelope Envelope
+		code     string
+	}{
+		{Envelope{Type: "chat", Version: 1, ID: 1, Payload: json.RawMessage(`{}`)}, ErrorUnknownType},
+		{Envelope{Type: MessageStatusUpdate, Version: 1, ID: 2, Payload: json.RawMessage(`{}`)}, ErrorUnsupportedType},
+		{Envelope{Type: MessagePlayMove, Version: 2, ID: 3, Payload: payload}, ErrorUnsupportedVersion},
+		{Envelope{Type: MessagePlayMove, Version: 1, ID: 4, Payload: json.RawMessage(`[1, 2]`)}, ErrorBadPayload},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			for _, c := range cases {
+				if err := WriteMessage(client, c.envelope); err != nil {
+					return err
+				}
+				var reply Envelope
+				if err := ReadMessage(client, &reply); err != nil {
+					return err
+				}
+				var errorReply ErrorReply
+				if err := json.Unmarshal(reply.Payload, &errorReply); err != nil {
+					return err
+				}
+				if reply.Type != MessageError || errorReply.Code != c.code || errorReply.ReplyTo != c.envelope.ID {
+					return errors.New("получен ответ " + string(reply.Type) + " " + errorReply.Code + ", ожидался " + c.code)
+				}
+			}
+			return WriteMessage(client, Envelope{Type: MessagePlayMove, Version: 1, ID: 5, Payload: payload})
+		}()
+	}()
+
+	// Отклонённые сообщения пропускаются, сервер получает только корректный ход
+	move, err := (&GameServer{}).receiveMove(newWire(server), game.ID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if move.GameID != sent.GameID {
+		t.Fatalf("получен ход %+v, ожидался %+v", move, sent)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeNegotiation(t *testing.T) {
+	for _, c := range []struct {
+		versions     []int
+		capabilities []string
+		version      int
+		negotiated   []string
+	}{
+		{[]int{1, 7}, []string{"chat", CapabilityTakeback}, 1, []string{CapabilityTakeback}},
+		{[]int{1}, Capabilities, 1, Capabilities},
+		{[]int{2, 3}, Capabilities, 0, nil},
+	} {
+		c := c
+		server, client := net.Pipe()
+		id := game.NewID()
+
+		go func() {
+			clientWire := newWire(client)
+			_ = clientWire.send(MessageHandshake, Hanshake{PlayerID: id, Versions: c.versions, Capabilities: c.capabilities})
+			var welcome Welcome
+			_, _ = clientWire.receive(map[MessageType]any{MessageWelcome: &welcome})
+		}()
+
+		w := newWire(server)
+		handshake, err := (&GameServer{}).Handshake(w)
+		if c.version == 0 {
+			var reply *ErrorReply
+			if !errors.As(err, &reply) || reply.Code != ErrorUnsupportedVersion {
+				t.Fatalf("версии %v: ожидалась ошибка %s, получено %v", c.versions, ErrorUnsupportedVersion, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handshake.PlayerID != id || w.version != c.version {
+				t.Fatalf("версии %v: согласована версия %d, ожидалась %d", c.versions, w.version, c.version)
+			}
+			for _, capability := range Capabilities {
+				want := false
+				for _, negotiated := range c.negotiated {
+					want = want || negotiated == capability
+				}
+				if w.supports(capability) != want {
+					t.Fatalf("возможности %v: %s согласована %v", c.capabilities, capability, !want)
+				}
+			}
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestMoveRejectedCapability(t *testing.T) {
+	for _, negotiated := range []bool{false, true} {
+		server, client := net.Pipe()
+		w := newWire(server)
+		w.capabilities = map[string]bool{CapabilityMoveRejected: negotiated}
+		player := &Player{ID: game.NewID(), conn: w}
+
+		// Клиент читает сообщения до состояния партии и сообщает, какое пришло первым
+		received := make(chan MessageType, 1)
+		go func() {
+			clientWire := newWire(client)
+			for first := MessageType(""); ; {
+				messageType, err := clientWire.receive(map[MessageType]any{
+					MessageMoveRejected: &MoveRejected{},
+					MessageStatusUpdate: &StatusUpdate{},
+				})
+				if first == "" {
+					first = messageType
+				}
+				if err != nil || messageType == MessageStatusUpdate {
+					received <- first
+					return
+				}
+			}
+		}()
+
+		// Клиент без возможности получает только следующее состояние
+		if err := (&GameServer{}).SendMoveRejected(player, &MoveRejected{Code: RejectIllegalMove}); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&GameServer{}).SendStatusUpdate(player, &StatusUpdate{}); err != nil {
+			t.Fatal(err)
+		}
+		want := MessageStatusUpdate
+		if negotiated {
+			want = MessageMoveRejected
+		}
+		if messageType := <-received; messageType != want {
+			t.Fatalf("возможность согласована %v: получено %s, ожидалось %s", negotiated, messageType, want)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	// Игрок без соединения не поддерживает ничего
+	if (&Player{}).Supports(CapabilityMoveRejected) {
+		t.Fatal("игрок без соединения поддерживает отклонение ходов")
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxMessageSize ограничивает размер JSON одного сообщения протокола.
+const MaxMessageSize = 1 << 20
+
+var ErrMessageTooLarge = errors.New("сообщение превышает допустимый размер")
+
+// Сообщения протокола передаются кадрами: длина JSON в байтах, записанная
+// четырьмя байтами в порядке big-endian, и сам JSON. Поэтому сообщения не
+// зависят от того, как TCP разбивает и склеивает данные.
+const headerSize = 4
+
+// WriteMessage записывает сообщение v одним кадром. Заголовок и JSON
+// передаются одним вызовом Write, чтобы кадры параллельных отправителей
+// не перемешивались.
+func WriteMessage(w io.Writer, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxMessageSize {
+		return fmt.Errorf("%w: %d байт", ErrMessageTooLarge, len(payload))
+	}
+
+	frame := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage читает один кадр и разбирает его JSON в v. Если соединение
+// закрыто между кадрами, возвращается io.EOF, если посреди кадра —
+// io.ErrUnexpectedEOF.
+func ReadMessage(r io.Reader, v any) error {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxMessageSize {
+		return fmt.Errorf("%w: %d байт", ErrMessageTooLarge, size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
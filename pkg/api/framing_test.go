@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hive/pkg/game"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func moves(n int) []PlayMove {
+	result := make([]PlayMove, n)
+	for i := range result {
+		result[i] = PlayMove{
+			GameID: game.NewID(),
+			Move: &game.Move{
+				Piece:    game.PieceID{Color: game.Black, Type: game.Spider, Number: i + 1},
+				Position: &game.Position{X: i, Y: -i},
+			},
+		}
+	}
+	return result
+}
+
+func envelope(t *testing.T, messageType MessageType, id uint64, payload any) Envelope {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Envelope{Type: messageType, Version: ProtocolVersion, ID: id, Payload: data}
+}
+
+func TestMessagesByteByByte(t *testing.T) {
+	var stream bytes.Buffer
+	sent := moves(3)
+	for _, move := range sent {
+		if err := WriteMessage(&stream, move); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := iotest.OneByteReader(&stream)
+	for _, want := range sent {
+		var got PlayMove
+		if err := ReadMessage(r, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.GameID != want.GameID || *got.Move.Position != *want.Move.Position {
+			t.Fatalf("получено %+v, ожидалось %+v", got, want)
+		}
+	}
+	var extra PlayMove
+	if err := ReadMessage(r, &extra); err != io.EOF {
+		t.Fatalf("после последнего кадра ожидался io.EOF, получено %v", err)
+	}
+}
+
+func TestMessagesBackToBack(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Оба кадра уходят одной записью, как при склейке пакетов TCP
+	sent := moves(2)
+	var stream bytes.Buffer
+	for i, move := range sent {
+		if err := WriteMessage(&stream, envelope(t, MessagePlayMove, uint64(i+1), move)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		_, _ = client.Write(stream.Bytes())
+	}()
+
+	gs := &GameServer{}
+	w := newWire(server)
+	for _, want := range sent {
+		got, err := gs.receiveMove(w, game.ID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.GameID != want.GameID || got.Move.Piece != want.Move.Piece {
+			t.Fatalf("получено %+v, ожидалось %+v", got, want)
+		}
+	}
+}
+
+func TestLargeMessageSplit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Доска больше прежнего буфера в 1024 байта, переданная мелкими частями
+	board := &game.Board{}
+	for i := 0; i < 200; i++ {
+		board.Pieces = append(board.Pieces, &game.Piece{Position: game.Position{X: i}, Type: game.SoldierAnt, Number: i + 1})
+	}
+	var stream bytes.Buffer
+	su := &StatusUpdate{GameState: &GameState{Board: board, Turn: 7}}
+	if err := WriteMessage(&stream, envelope(t, MessageStatusUpdate, 1, su)); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		data := stream.Bytes()
+		for len(data) > 0 {
+			n := 100
+			if n > len(data) {
+				n = len(data)
+			}
+			_, _ = client.Write(data[:n])
+			data = data[n:]
+		}
+	}()
+
+	su = &StatusUpdate{}
+	if _, err := newWire(server).receive(map[MessageType]any{MessageStatusUpdate: su}); err != nil {
+		t.Fatal(err)
+	}
+	if len(su.GameState.Board.Pieces) != 200 || su.GameState.Turn != 7 {
+		t.Fatalf("доска восстановлена не полностью: %d фигур", len(su.GameState.Board.Pieces))
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	if err := WriteMessage(io.Discard, strings.Repeat("x", MaxMessageSize)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("запись: ожидалась ErrMessageTooLarge, получено %v", err)
+	}
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[:], MaxMessageSize+1)
+	var v PlayMove
+	if err := ReadMessage(bytes.NewReader(header[:]), &v); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("чтение: ожидалась ErrMessageTooLarge, получено %v", err)
+	}
+}
+
+func TestTruncatedMessage(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteMessage(&stream, moves(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	truncated := stream.Bytes()[:stream.Len()-1]
+	var v PlayMove
+	if err := ReadMessage(bytes.NewReader(truncated), &v); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ожидалась io.ErrUnexpectedEOF, получено %v", err)
+	}
+}
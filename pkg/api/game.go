@@ -3,46 +3,156 @@ package api
 import (
 	"context"
 	"hive/pkg/game"
+	"time"
 )
 
+// Hanshake представляет игрока серверу. Rules — вариант правил, по которому
+// игрок хочет играть; nil означает правила сервера. Versions и Capabilities
+// перечисляют версии протокола и возможности клиента, сервер отвечает
+// сообщением Welcome с выбранными. Games — сколько партий игрок хочет
+// играть одновременно по этому соединению; 0 означает одну.
 type Hanshake struct {
-	PlayerID game.ID
+	PlayerID     game.ID
+	Rules        *game.Rules
+	Versions     []int
+	Capabilities []string
+	Games        int
 }
 
+// PlayMove передаёт ход игрока. Пропуск хода передаётся как Move с Pass, равным true.
+// Вместо хода игрок может запросить отмену своего последнего хода (Takeback)
+// или ответить на такой запрос соперника (TakebackReply). Запрос принимается
+// только в очередь запросившего игрока, когда соперник уже ответил на его
+// ход; иначе он отклоняется с кодом RejectTakebackNotAllowed.
+//
+// В любой момент, не дожидаясь своей очереди, игрок может сдаться (Resign),
+// предложить ничью (DrawOffer) или ответить на предложение соперника
+// (DrawReply), а до своего первого хода — прервать партию (Abort).
 type PlayMove struct {
-	GameID game.ID
-	Move   *game.Move
+	GameID        game.ID
+	Move          *game.Move
+	Takeback      *TakebackRequest
+	TakebackReply *TakebackReply
+	Resign        *Resign
+	DrawOffer     *DrawOffer
+	DrawReply     *DrawReply
+	Abort         *Abort
 }
 
+// StatusUpdate с TakebackOffer просит игрока ответить на запрос соперника
+// об отмене хода, TakebackReply сообщает запросившему игроку ответ.
+// Rules передаётся в первом обновлении партии, которое получает игрок.
+//
+// StatusUpdate без GameState только уведомляет игрока: DrawOffer — о
+// предложении ничьей, DrawReply — об отказе соперника от предложенной ничьей.
 type StatusUpdate struct {
+	GameID        game.ID
+	Rules         *game.Rules
+	GameState     *GameState
+	GameFailed    *GameFailed
+	GameFinished  *GameFinished
+	TakebackOffer *TakebackRequest
+	TakebackReply *TakebackReply
+	DrawOffer     *DrawOffer
+	DrawReply     *DrawReply
+}
+
+// TakebackRequest — запрос на отмену последнего хода запросившего игрока
+// вместе с последовавшим за ним ходом соперника.
+type TakebackRequest struct{}
+
+type TakebackReply struct {
+	Accepted bool
+}
+
+type Resign struct{}
+
+// DrawOffer — предложение ничьей. Оно действует, пока соперник не ответит
+// или не сделает ход. Встречное предложение равносильно согласию.
+type DrawOffer struct{}
+
+type DrawReply struct {
+	Accepted bool
+}
+
+// Abort прерывает партию без результата. Игрок может прервать партию,
+// пока не сделал свой первый ход.
+type Abort struct{}
+
+// MoveRejected сообщает игроку причину, по которой его ход или действие
+// отклонены. Состояние партии не изменилось; если сейчас очередь игрока,
+// следом он получит его повторно.
+// AttemptsLeft — сколько ещё недопустимых ходов подряд приведут к поражению,
+// или -1, если число попыток не ограничено.
+type MoveRejected struct {
 	GameID       game.ID
-	GameState    *GameState
-	GameFailed   *GameFailed
-	GameFinished *GameFinished
+	Move         *game.Move
+	Code         string
+	Message      string
+	AttemptsLeft int
 }
 
 type GameFailed struct {
 	Error string
 }
 
+// GameFinished — итог партии. Winer и Tie сообщают результат игроку,
+// получившему сообщение; Winner равен nil при ничьей и прерванной партии.
+// Board — итоговая позиция, Moves — ходы партии в стандартной нотации.
 type GameFinished struct {
-	Winer bool
-	Tie   bool
+	Winer     bool
+	Tie       bool
+	Reason    string
+	Winner    *Winner
+	Board     *game.Board
+	MoveCount int
+	Moves     []string
+}
+
+type Winner struct {
+	Color    game.PieceColor
+	PlayerID game.ID
 }
 
+// Причины завершения партии.
+const (
+	ReasonQueenSurrounded = "queen_surrounded"
+	ReasonBothSurrounded  = "both_surrounded"
+	ReasonRepetition      = "repetition"
+	ReasonRulesInfraction = "rules_infraction"
+	ReasonTimeout         = "timeout"
+	ReasonResignation     = "resignation"
+	ReasonAgreement       = "agreement"
+	ReasonDisconnect      = "disconnect"
+	ReasonAborted         = "aborted"
+)
+
+// GameState — состояние партии с точки зрения игрока. Clocks равно nil,
+// если партия играется без часов.
 type GameState struct {
 	Board        *game.Board
 	Hand         *game.Hand
 	OpponentHand *game.Hand
 	Turn         int
+	Clocks       *Clocks
+	// LastMoved — фигура, сходившая последним ходом: до следующего хода
+	// мокрица не может её бросить.
+	LastMoved *game.PieceID
+}
+
+// Clocks — время игрока и соперника, оставшееся на момент отправки состояния.
+type Clocks struct {
+	Time         time.Duration
+	OpponentTime time.Duration
 }
 
 type ClientServise interface {
 	HandleStatusUpdate(ctx context.Context, statusUpdate *StatusUpdate) error
+	HandleMoveRejected(ctx context.Context, rejected *MoveRejected) error
 }
 
 type ServerServise interface {
-	CreateNewGame(first, second *Player) *Game
+	CreateNewGame(first, second *Player) (*Game, error)
 	StartGame(ctx context.Context, game *Game) error
 	UpdateGameState(game *Game, move *game.Move) (*StatusUpdate, error)
 }
@@ -2,115 +2,207 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"hive/pkg/game"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// Задержка между попытками переподключения растёт вдвое от reconnectDelay
+// до maxReconnectDelay.
+const (
+	reconnectDelay    = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// DefaultReconnectTimeout — сколько клиент по умолчанию пытается
+// переподключиться после обрыва соединения.
+const DefaultReconnectTimeout = 30 * time.Second
+
 type GameClient struct {
 	ID       game.ID
 	logger   *zap.Logger
 	endpoint string
-	conn     net.Conn
+	connMu   sync.Mutex
+	conn     *wire
 	cs       ClientServise
+
+	// Rules — вариант правил, который игрок выбирает при подключении;
+	// nil означает правила сервера.
+	Rules *game.Rules
+	// Games — сколько партий игрок играет одновременно по одному соединению.
+	// Обновления разных партий различаются по GameID.
+	Games int
+	// ReconnectTimeout — сколько клиент пытается подключиться заново после
+	// обрыва соединения; 0 отключает переподключение.
+	ReconnectTimeout time.Duration
 }
 
 func NewGameClient(logger *zap.Logger, endpoint string, cs ClientServise) *GameClient {
 	return &GameClient{
-		ID:       game.NewID(),
-		logger:   logger,
-		endpoint: endpoint,
-		cs:       cs,
+		ID:               game.NewID(),
+		logger:           logger,
+		endpoint:         endpoint,
+		cs:               cs,
+		ReconnectTimeout: DefaultReconnectTimeout,
 	}
 }
 
+// Connect подключается к серверу и согласует версию протокола. Повторное
+// подключение с тем же ID продолжает партии игрока.
 func (c *GameClient) Connect() error {
 	conn, err := net.Dial("tcp", c.endpoint)
 	if err != nil {
 		return err
 	}
-	c.conn = conn
-	if err = c.Handshake(); err != nil {
+	w := newWire(conn)
+	if err = c.handshake(w); err != nil {
+		_ = conn.Close()
 		return err
 	}
+	c.connMu.Lock()
+	c.conn = w
+	c.connMu.Unlock()
 	return nil
 }
 
 func (c *GameClient) Close() error {
-	err := c.conn.Close()
-	if err != nil {
-		return err
+	return c.connection().conn.Close()
+}
+
+func (c *GameClient) connection() *wire {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+// reconnect подключается заново после обрыва соединения, увеличивая
+// задержку между попытками, пока не истечёт ReconnectTimeout.
+func (c *GameClient) reconnect(ctx context.Context, cause error) error {
+	if c.ReconnectTimeout <= 0 {
+		return cause
 	}
-	return nil
+	c.logger.Warn("Соединение с сервером потеряно", zap.Error(cause))
+	_ = c.Close()
+
+	deadline := time.Now().Add(c.ReconnectTimeout)
+	delay := reconnectDelay
+	for {
+		err := c.Connect()
+		if err == nil {
+			c.logger.Info("Соединение с сервером восстановлено")
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// disconnected сообщает, что ошибка вызвана обрывом соединения.
+func disconnected(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
 }
 
+// HandleUpdates обрабатывает сообщения сервера, пока не закончатся все
+// партии игрока. После обрыва соединения клиент подключается заново, и
+// сервер повторяет состояние партий, в которых ждёт хода игрока.
 func (c *GameClient) HandleUpdates(ctx context.Context) error {
+	games := c.Games
+	if games < 1 {
+		games = 1
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
-			statusUpdate, err := c.ReceiveStatusUpdate()
+			finished, err := c.handleUpdate(ctx)
 			if err != nil {
-				return err
+				if ctx.Err() != nil || !disconnected(err) {
+					return err
+				}
+				if err = c.reconnect(ctx, err); err != nil {
+					return err
+				}
+				continue
 			}
-			err = c.cs.HandleStatusUpdate(ctx, statusUpdate)
-			if err != nil {
-				return err
+			if finished {
+				if games--; games == 0 {
+					return nil
+				}
 			}
 		}
 	}
 }
 
-func (c *GameClient) Handshake() error {
-	handshake := Hanshake{PlayerID: c.ID}
-	data, err := json.Marshal(handshake)
+// handleUpdate обрабатывает следующее сообщение сервера и сообщает,
+// закончилась ли одна из партий.
+func (c *GameClient) handleUpdate(ctx context.Context) (bool, error) {
+	var su StatusUpdate
+	var rejected MoveRejected
+	var reply ErrorReply
+	messageType, err := c.connection().receive(map[MessageType]any{
+		MessageStatusUpdate: &su,
+		MessageMoveRejected: &rejected,
+		MessageError:        &reply,
+	})
 	if err != nil {
-		return err
+		return false, err
 	}
-	_, err = c.conn.Write(data)
-	if err != nil {
-		return err
+
+	switch messageType {
+	case MessageError:
+		c.logger.Warn("Сервер отклонил сообщение", zap.Error(&reply))
+	case MessageMoveRejected:
+		return false, c.cs.HandleMoveRejected(ctx, &rejected)
+	case MessageStatusUpdate:
+		if err = c.cs.HandleStatusUpdate(ctx, &su); err != nil {
+			return false, err
+		}
+		return su.GameFinished != nil || su.GameFailed != nil, nil
 	}
-	return nil
+	return false, nil
 }
 
-func (c *GameClient) SendMove(move PlayMove) error {
-	moveData, err := json.Marshal(move)
-	if err != nil {
+func (c *GameClient) Handshake() error {
+	return c.handshake(c.connection())
+}
+
+func (c *GameClient) handshake(w *wire) error {
+	handshake := Hanshake{
+		PlayerID:     c.ID,
+		Rules:        c.Rules,
+		Versions:     SupportedVersions,
+		Capabilities: Capabilities,
+		Games:        c.Games,
+	}
+	if err := w.send(MessageHandshake, handshake); err != nil {
 		return err
 	}
-
-	_, err = c.conn.Write(moveData)
-	if err != nil {
+	var welcome Welcome
+	if _, err := w.receive(map[MessageType]any{MessageWelcome: &welcome}); err != nil {
 		return err
 	}
-
+	w.accept(&welcome)
+	c.logger.Info("Согласована версия протокола", zap.Int("version", welcome.Version), zap.Strings("capabilities", welcome.Capabilities))
 	return nil
 }
 
-func (c *GameClient) ReceiveStatusUpdate() (*StatusUpdate, error) {
-	var buffer []byte
-	tempBuffer := make([]byte, 1024)
-	// <-time.After(time.Second)
-	for {
-		n, err := c.conn.Read(tempBuffer)
-		if err != nil {
-			return nil, err
-		}
-		buffer = append(buffer, tempBuffer[:n]...)
-		if n < 1024 {
-			break // Прочитаны все данные
-		}
-	}
-
-	var su StatusUpdate
-	err := json.Unmarshal(buffer, &su)
-	if err != nil {
-		return nil, err
-	}
-
-	return &su, nil
+func (c *GameClient) SendMove(move PlayMove) error {
+	return c.connection().send(MessagePlayMove, move)
 }
@@ -2,9 +2,11 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"hive/pkg/game"
+	"hive/pkg/notation"
+	"hive/pkg/record"
 	"net"
 	"sync"
 
@@ -15,6 +17,9 @@ type Game struct {
 	ID      game.ID
 	Players []game.ID
 	Session *game.GameSession
+	Record  *record.Record
+	// Clock — часы партии или nil, если партия играется без контроля времени.
+	Clock *game.Clock
 }
 
 type GameServer struct {
@@ -49,23 +54,155 @@ func (s *GameServer) GetActiveGameCount() int {
 	return len(s.games)
 }
 
+// Player — подключённый игрок. По одному соединению игрок может играть
+// несколько партий сразу: читающая горутина соединения раскладывает его
+// ходы по очередям партий. После обрыва игрок может подключиться заново
+// с тем же ID, и его партии продолжатся по новому соединению.
 type Player struct {
-	ID     game.ID
-	conn   net.Conn
-	gameMu sync.Mutex
-	gameID map[game.ID]*Game
+	ID      game.ID
+	gameMu  sync.Mutex
+	gameID  map[game.ID]*Game
+	inboxes map[game.ID]*inbox
+
+	connMu sync.Mutex
+	conn   *wire
+	// lost закрывается, когда соединение conn потеряно, а reconnected —
+	// когда игрок подключился заново
+	lost        chan struct{}
+	reconnected chan struct{}
+	// epoch — номер соединения conn, растёт при каждом подключении
+	epoch int
+	// results — итоги партий, не дошедшие до игрока из-за потери
+	// соединения; игрок получит их, когда подключится заново
+	results []*StatusUpdate
+
+	// Rules — вариант правил, выбранный игроком при подключении, или nil.
+	Rules *game.Rules
+}
+
+// inbox — очередь ходов игрока в одной партии.
+type inbox struct {
+	moves   chan *PlayMove
+	removed chan struct{}
+	// reconnected — ожидание возвращения игрока после потери соединения,
+	// о которой сообщил ReceiveMove
+	reconnected chan struct{}
+	// epoch — номер соединения, по которому партия получает ходы
+	epoch int
+}
+
+// inboxSize — сколько ходов партии может ждать обработки, прежде чем
+// чтение соединения остановится.
+const inboxSize = 8
+
+var (
+	// ErrGameRemoved возвращает ReceiveMove для партии, которой у игрока больше нет.
+	ErrGameRemoved = errors.New("партия завершена")
+	// ErrDisconnected возвращает ReceiveMove, когда соединение с игроком потеряно.
+	ErrDisconnected = errors.New("соединение с игроком потеряно")
+)
+
+// Supports сообщает, согласовал ли игрок при рукопожатии возможность capability.
+func (p *Player) Supports(capability string) bool {
+	return p.connection().supports(capability)
+}
+
+// HasGames сообщает, играет ли игрок сейчас хотя бы одну партию.
+func (p *Player) HasGames() bool {
+	p.gameMu.Lock()
+	defer p.gameMu.Unlock()
+	return len(p.gameID) > 0
 }
 
 func (p *Player) AddGame(game *Game) {
 	p.gameMu.Lock()
 	defer p.gameMu.Unlock()
+	_, _, epoch := p.link()
 	p.gameID[game.ID] = game
+	p.inboxes[game.ID] = &inbox{moves: make(chan *PlayMove, inboxSize), removed: make(chan struct{}), epoch: epoch}
 }
 
 func (p *Player) RemoveGame(ID game.ID) {
 	p.gameMu.Lock()
 	defer p.gameMu.Unlock()
 	delete(p.gameID, ID)
+	if in, ok := p.inboxes[ID]; ok {
+		close(in.removed)
+		delete(p.inboxes, ID)
+	}
+}
+
+func (p *Player) inbox(ID game.ID) (*inbox, bool) {
+	p.gameMu.Lock()
+	defer p.gameMu.Unlock()
+	in, ok := p.inboxes[ID]
+	return in, ok
+}
+
+func newPlayer(ID game.ID) *Player {
+	return &Player{
+		ID:      ID,
+		gameID:  make(map[game.ID]*Game),
+		inboxes: make(map[game.ID]*inbox),
+	}
+}
+
+func (p *Player) connection() *wire {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.conn
+}
+
+// online сообщает, что соединение игрока ещё не потеряно.
+func (p *Player) online() bool {
+	lost, _, _ := p.link()
+	if lost == nil {
+		return false
+	}
+	select {
+	case <-lost:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *Player) link() (lost, reconnected chan struct{}, epoch int) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.lost, p.reconnected, p.epoch
+}
+
+// connect привязывает игрока к соединению w. Прежнее соединение, если оно
+// ещё открыто, закрывается. Возвращаются канал, который закроется при
+// потере нового соединения, и итоги партий, не дошедшие до игрока.
+func (p *Player) connect(w *wire) (chan struct{}, []*StatusUpdate) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.conn != nil {
+		_ = p.conn.conn.Close()
+		close(p.reconnected)
+	}
+	p.conn = w
+	p.epoch += 1
+	p.lost = make(chan struct{})
+	p.reconnected = make(chan struct{})
+	results := p.results
+	p.results = nil
+	return p.lost, results
+}
+
+// deferResult откладывает итог партии, не отправленный по соединению w,
+// до переподключения игрока. Если игрок уже подключился заново, итог не
+// откладывается.
+func (p *Player) deferResult(w *wire, su *StatusUpdate) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.conn != w {
+		return false
+	}
+	p.results = append(p.results, su)
+	return true
 }
 
 func NewGameServer(logger *zap.Logger, endpoint string, ss ServerServise) *GameServer {
@@ -83,15 +220,23 @@ func (s *GameServer) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	s.Serve(ctx, listener)
+	return nil
+}
 
+// Serve принимает подключения игроков на listener и сводит их в партии.
+// Рукопожатие с каждым подключением идёт в своей горутине, чтобы медленный
+// клиент не задерживал остальных.
+func (s *GameServer) Serve(ctx context.Context, listener net.Listener) {
 	s.log.Info("Сервер запущен. Ожидание подключений...")
 
-	go func() error {
-		var waitingPlayer *Player
+	joins := make(chan joined)
+	go s.matchPlayers(ctx, joins)
+	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				return nil
+				return
 			default:
 				if s.GetActiveGameCount() >= 20 {
 					continue
@@ -102,63 +247,161 @@ func (s *GameServer) Start(ctx context.Context) error {
 					s.log.Error("Ошибка при принятии подключения:", zap.Error(err))
 					continue
 				}
-				hs, err := s.Handshake(conn)
-				if err != nil {
-					s.log.Error("Ошибка аунтификации:", zap.Error(err))
-					continue
-				}
+				go s.join(ctx, conn, joins)
+			}
+		}
+	}()
+}
 
-				var player *Player
-				var ok bool
-				s.playerMu.Lock()
-				player, ok = s.players[hs.PlayerID]
-				if !ok {
-					player = &Player{ID: hs.PlayerID, conn: conn, gameID: make(map[game.ID]*Game)}
-					s.players[player.ID] = player
-				}
-				s.playerMu.Unlock()
+// joined — подключение игрока, прошедшее рукопожатие.
+type joined struct {
+	w  *wire
+	hs *Hanshake
+}
 
-				if waitingPlayer == nil {
-					waitingPlayer = player
-					continue
-				} else if waitingPlayer.ID == player.ID {
-					continue
-				}
+// join проводит рукопожатие с подключением conn и передаёт его в joins.
+func (s *GameServer) join(ctx context.Context, conn net.Conn, joins chan<- joined) {
+	w := newWire(conn)
+	hs, err := s.Handshake(w)
+	if err != nil {
+		s.log.Error("Ошибка аунтификации:", zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+	select {
+	case joins <- joined{w: w, hs: hs}:
+	case <-ctx.Done():
+		_ = conn.Close()
+	}
+}
 
-				game := s.ss.CreateNewGame(waitingPlayer, player)
-				waitingPlayer.AddGame(game)
-				player.AddGame(game)
-				s.AddGame(game)
-				s.wg.Add(1)
-				go func(fp, sp *Player) {
-					if err = s.ss.StartGame(ctx, game); err != nil {
-						s.log.Error("Ошибка игровой сессии", zap.Error(err))
-					}
-					fp.RemoveGame(game.ID)
-					sp.RemoveGame(game.ID)
-					s.RemoveGame(game.ID)
-				}(waitingPlayer, player)
-
-				s.log.Info("Игра началась. Игроки:", zap.Any("first", waitingPlayer.ID), zap.Any("second", player.ID))
-				waitingPlayer = nil
+// matchPlayers привязывает подключившихся игроков к соединениям и сводит их
+// в партии. Игроки ждут соперника, выбравшего тот же вариант правил. Игрок,
+// желающий сыграть несколько партий, стоит в очереди несколько раз.
+func (s *GameServer) matchPlayers(ctx context.Context, joins <-chan joined) {
+	waiting := map[string][]*Player{}
+	for {
+		var next joined
+		select {
+		case <-ctx.Done():
+			return
+		case next = <-joins:
+		}
+
+		var player *Player
+		var ok bool
+		s.playerMu.Lock()
+		player, ok = s.players[next.hs.PlayerID]
+		if !ok {
+			player = newPlayer(next.hs.PlayerID)
+			s.players[player.ID] = player
+		}
+		player.Rules = next.hs.Rules
+		s.playerMu.Unlock()
+		lost, results := player.connect(next.w)
+		go s.readMoves(player, next.w, lost)
+
+		// Игрок вернулся после обрыва: его партии продолжаются, а итоги
+		// закончившихся без него партий он получает сейчас. Новые партии
+		// вернувшемуся игроку не подбираются
+		for _, su := range results {
+			if err := s.SendStatusUpdate(player, su); err != nil {
+				s.log.Error("Ошибка при отправке итога партии", zap.Any("player", player.ID), zap.Error(err))
 			}
 		}
-	}()
-	return nil
+		if player.HasGames() || len(results) > 0 {
+			s.log.Info("Игрок переподключился", zap.Any("player", player.ID))
+			continue
+		}
+		// Игроки, потерявшие соединение в очереди, соперниками не станут
+		for key, queue := range waiting {
+			waiting[key] = filterPlayers(queue, func(queued *Player) bool {
+				return queued.ID != player.ID && queued.online()
+			})
+		}
+
+		key := ""
+		if player.Rules != nil {
+			key = notation.FormatRules(*player.Rules)
+		}
+		games := next.hs.Games
+		if games < 1 {
+			games = 1
+		}
+		for i := 0; i < games; i++ {
+			opponent := -1
+			for j, waitingPlayer := range waiting[key] {
+				if waitingPlayer.ID != player.ID {
+					opponent = j
+					break
+				}
+			}
+			if opponent == -1 {
+				waiting[key] = append(waiting[key], player)
+				continue
+			}
+			waitingPlayer := waiting[key][opponent]
+			waiting[key] = append(waiting[key][:opponent], waiting[key][opponent+1:]...)
+			s.startGame(ctx, waitingPlayer, player)
+		}
+	}
 }
 
-func (s *GameServer) Handshake(conn net.Conn) (*Hanshake, error) {
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
+// filterPlayers оставляет в очереди игроков, для которых keep возвращает true.
+func filterPlayers(queue []*Player, keep func(*Player) bool) []*Player {
+	result := queue[:0]
+	for _, player := range queue {
+		if keep(player) {
+			result = append(result, player)
+		}
+	}
+	return result
+}
+
+func (s *GameServer) startGame(ctx context.Context, fp, sp *Player) {
+	game, err := s.ss.CreateNewGame(fp, sp)
 	if err != nil {
-		return nil, err
+		s.log.Error("Ошибка создания игры", zap.Error(err))
+		return
 	}
+	fp.AddGame(game)
+	sp.AddGame(game)
+	s.AddGame(game)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.ss.StartGame(ctx, game); err != nil {
+			s.log.Error("Ошибка игровой сессии", zap.Error(err))
+		}
+		fp.RemoveGame(game.ID)
+		sp.RemoveGame(game.ID)
+		s.RemoveGame(game.ID)
+	}()
 
+	s.log.Info("Игра началась. Игроки:", zap.Any("first", fp.ID), zap.Any("second", sp.ID))
+}
+
+// Handshake принимает рукопожатие игрока, проверяет выбранный им вариант
+// правил и согласует версию протокола и возможности.
+func (s *GameServer) Handshake(w *wire) (*Hanshake, error) {
 	var handshake Hanshake
-	if err = json.Unmarshal(buffer[:n], &handshake); err != nil {
+	if _, err := w.receive(map[MessageType]any{MessageHandshake: &handshake}); err != nil {
 		return nil, err
 	}
-	return &handshake, nil
+
+	welcome, ok := w.negotiate(handshake.Versions, handshake.Capabilities)
+	if !ok {
+		reply := &ErrorReply{Code: ErrorUnsupportedVersion, Message: fmt.Sprintf("сервер поддерживает версии протокола %v", SupportedVersions)}
+		_ = w.send(MessageError, reply)
+		return nil, reply
+	}
+	if handshake.Rules != nil {
+		if err := handshake.Rules.Validate(); err != nil {
+			_ = w.send(MessageError, &ErrorReply{Code: ErrorBadPayload, Message: err.Error()})
+			return nil, err
+		}
+	}
+	return &handshake, w.send(MessageWelcome, welcome)
 }
 
 func (s *GameServer) GetPlayer(playerID game.ID) (*Player, error) {
@@ -172,39 +415,144 @@ func (s *GameServer) GetPlayer(playerID game.ID) (*Player, error) {
 	return player, nil
 }
 
-func (s *GameServer) ReceiveMove(player *Player) (*PlayMove, error) {
-	var buffer []byte
-	tempBuffer := make([]byte, 1024)
+// readMoves читает сообщения игрока из соединения w, пока оно не
+// закроется, и раскладывает ходы по очередям партий. Ход в партии, в
+// которой игрок не участвует, отклоняется.
+func (s *GameServer) readMoves(player *Player, w *wire, lost chan struct{}) {
+	defer close(lost)
+	defer w.conn.Close()
 	for {
-		n, err := player.conn.Read(tempBuffer)
+		move, err := s.receiveMove(w, player.ID)
 		if err != nil {
-			return nil, err
+			s.log.Info("Соединение с игроком потеряно", zap.Any("player", player.ID), zap.Error(err))
+			return
+		}
+
+		in, ok := player.inbox(move.GameID)
+		if !ok {
+			s.log.Warn("Ход в чужой партии", zap.Any("player", player.ID), zap.Any("game", move.GameID))
+			err = s.SendMoveRejected(player, &MoveRejected{
+				GameID:       move.GameID,
+				Move:         move.Move,
+				Code:         RejectUnknownGame,
+				Message:      "игрок не участвует в этой партии",
+				AttemptsLeft: -1,
+			})
+			if err != nil {
+				s.log.Info("Соединение с игроком потеряно", zap.Any("player", player.ID), zap.Error(err))
+				return
+			}
+			continue
 		}
-		buffer = append(buffer, tempBuffer[:n]...)
-		if n < 1024 {
-			break // Прочитаны все данные
+		select {
+		case in.moves <- move:
+		case <-in.removed:
 		}
 	}
+}
 
-	var move PlayMove
-	err := json.Unmarshal(buffer, &move)
-	if err != nil {
-		return nil, err
+// ReceiveMove ждёт следующий ход игрока в партии gameID. Ходы одной
+// партии читаются из одной горутины. При потере соединения возвращается
+// ErrDisconnected, и возвращения игрока можно дождаться через AwaitReconnect.
+// Обрыв и переподключение между вызовами тоже сообщаются через
+// ErrDisconnected, а AwaitReconnect тогда возвращается сразу.
+func (s *GameServer) ReceiveMove(player *Player, gameID game.ID) (*PlayMove, error) {
+	in, ok := player.inbox(gameID)
+	if !ok {
+		return nil, ErrGameRemoved
+	}
+	lost, reconnected, epoch := player.link()
+	// Ходы, пришедшие до обрыва, обрабатываются раньше известия о нём
+	if move, ok := buffered(in); ok {
+		return move, nil
+	}
+	if epoch != in.epoch {
+		in.epoch = epoch
+		in.reconnected = make(chan struct{})
+		close(in.reconnected)
+		return nil, ErrDisconnected
+	}
+	select {
+	case move := <-in.moves:
+		return move, nil
+	case <-in.removed:
+		return nil, ErrGameRemoved
+	case <-lost:
+		if move, ok := buffered(in); ok {
+			return move, nil
+		}
+		in.reconnected = reconnected
+		return nil, ErrDisconnected
 	}
+}
 
-	return &move, nil
+// buffered возвращает ход из очереди партии, не дожидаясь его.
+func buffered(in *inbox) (*PlayMove, bool) {
+	select {
+	case move := <-in.moves:
+		return move, true
+	default:
+		return nil, false
+	}
 }
 
-func (s *GameServer) SendStatusUpdate(player *Player, su *StatusUpdate) error {
-	data, err := json.Marshal(su)
-	if err != nil {
-		return err
+// AwaitReconnect ждёт, пока игрок подключится заново после потери
+// соединения, о которой сообщил ReceiveMove, или партия завершится.
+func (s *GameServer) AwaitReconnect(player *Player, gameID game.ID) error {
+	in, ok := player.inbox(gameID)
+	if !ok {
+		return ErrGameRemoved
+	}
+	select {
+	case <-in.reconnected:
+		_, _, in.epoch = player.link()
+		return nil
+	case <-in.removed:
+		return ErrGameRemoved
 	}
+}
 
-	_, err = player.conn.Write(data)
-	if err != nil {
-		return err
+// receiveMove читает из соединения w следующий ход игрока. Ответы игрока
+// об ошибках в сообщениях сервера записываются в журнал.
+func (s *GameServer) receiveMove(w *wire, playerID game.ID) (*PlayMove, error) {
+	for {
+		var move PlayMove
+		var reply ErrorReply
+		messageType, err := w.receive(map[MessageType]any{
+			MessagePlayMove: &move,
+			MessageError:    &reply,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if messageType == MessagePlayMove {
+			return &move, nil
+		}
+		s.log.Warn("Игрок отклонил сообщение", zap.Any("player", playerID), zap.Error(&reply))
 	}
+}
 
-	return nil
+// SendStatusUpdate отправляет игроку обновление партии. Итог партии, не
+// дошедший из-за потери соединения, игрок получит, когда подключится заново.
+func (s *GameServer) SendStatusUpdate(player *Player, su *StatusUpdate) error {
+	for {
+		w := player.connection()
+		err := w.send(MessageStatusUpdate, su)
+		if err == nil || su.GameFinished == nil {
+			return err
+		}
+		if player.deferResult(w, su) {
+			return nil
+		}
+		// Игрок уже подключился заново: итог отправляется по новому соединению
+	}
+}
+
+// SendMoveRejected сообщает игроку, что его ход отклонён, если игрок
+// поддерживает такие сообщения.
+func (s *GameServer) SendMoveRejected(player *Player, rejected *MoveRejected) error {
+	if !player.Supports(CapabilityMoveRejected) {
+		return nil
+	}
+	return player.connection().send(MessageMoveRejected, rejected)
 }
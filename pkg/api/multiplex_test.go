@@ -0,0 +1,460 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hive/pkg/game"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// scriptedServer ведёт каждую партию заданное число ходов: игроки ходят по
+// очереди, и номер хода в ответе должен совпасть с номером в состоянии.
+// Игроку, вернувшемуся после обрыва, состояние отправляется заново.
+type scriptedServer struct {
+	gs    *GameServer
+	turns int
+
+	mu       sync.Mutex
+	finished int
+	errs     []error
+	// pairs — игроки созданных партий
+	pairs [][2]game.ID
+}
+
+func (s *scriptedServer) CreateNewGame(first, second *Player) (*Game, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pairs = append(s.pairs, [2]game.ID{first.ID, second.ID})
+	return &Game{ID: game.NewID(), Players: []game.ID{first.ID, second.ID}}, nil
+}
+
+func (s *scriptedServer) StartGame(ctx context.Context, g *Game) error {
+	err := s.play(g)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished += 1
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	return err
+}
+
+func (s *scriptedServer) play(g *Game) error {
+	players := make([]*Player, 2)
+	for i, id := range g.Players {
+		player, err := s.gs.GetPlayer(id)
+		if err != nil {
+			return err
+		}
+		players[i] = player
+	}
+
+	for turn := 0; turn < s.turns; turn++ {
+		player := players[turn%2]
+		err := s.gs.SendStatusUpdate(player, &StatusUpdate{GameID: g.ID, GameState: &GameState{Turn: turn}})
+		if err != nil {
+			return err
+		}
+		move, err := s.gs.ReceiveMove(player, g.ID)
+		if errors.Is(err, ErrDisconnected) {
+			if err = s.gs.AwaitReconnect(player, g.ID); err != nil {
+				return err
+			}
+			turn--
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if move.GameID != g.ID || move.Move == nil || move.Move.Position.X != turn {
+			return fmt.Errorf("партия %v, ход %d: получен %+v", g.ID, turn, move)
+		}
+	}
+	for _, player := range players {
+		if err := s.gs.SendStatusUpdate(player, &StatusUpdate{GameID: g.ID, GameFinished: &GameFinished{MoveCount: s.turns}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scriptedServer) UpdateGameState(*Game, *game.Move) (*StatusUpdate, error) {
+	return nil, nil
+}
+
+// replyingClient отвечает на каждое состояние со случайной задержкой, не
+// дожидаясь ответов в других партиях, поэтому ходы партий перемешиваются.
+// Получив состояние с номером хода dropAt, клиент один раз обрывает
+// соединение вместо ответа.
+type replyingClient struct {
+	gc     *GameClient
+	dropAt int
+
+	mu       sync.Mutex
+	finished map[game.ID]int
+	rejected []string
+	errs     []error
+}
+
+func (c *replyingClient) HandleStatusUpdate(ctx context.Context, su *StatusUpdate) error {
+	if su.GameFinished != nil {
+		c.mu.Lock()
+		c.finished[su.GameID] = su.GameFinished.MoveCount
+		c.mu.Unlock()
+		return nil
+	}
+	if c.dropAt > 0 && su.GameState.Turn == c.dropAt {
+		c.dropAt = 0
+		return c.gc.Close()
+	}
+	go func() {
+		time.Sleep(time.Duration(rand.Intn(3000)) * time.Microsecond)
+		err := c.gc.SendMove(PlayMove{GameID: su.GameID, Move: &game.Move{Position: &game.Position{X: su.GameState.Turn}}})
+		if err != nil {
+			c.mu.Lock()
+			c.errs = append(c.errs, err)
+			c.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (c *replyingClient) HandleMoveRejected(ctx context.Context, rejected *MoveRejected) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected = append(c.rejected, rejected.Code)
+	return nil
+}
+
+func TestInterleavedGames(t *testing.T) {
+	clients := playGames(t, 3, 20, 0, func(c *GameClient) {
+		// Ход в партии, которой нет, отклоняется и не мешает остальным
+		if err := c.SendMove(moves(1)[0]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if rejected := clients[0].rejected; len(rejected) != 1 || rejected[0] != RejectUnknownGame {
+		t.Fatalf("отклонения хода в чужой партии: %v", rejected)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	clients := playGames(t, 1, 20, 6, func(*GameClient) {})
+	if clients[0].dropAt != 0 {
+		t.Fatal("соединение не обрывалось")
+	}
+}
+
+// TestReconnectBetweenMoves проверяет обрыв и переподключение, пока
+// партия обрабатывает полученный ход и не ждёт следующего.
+func TestReconnectBetweenMoves(t *testing.T) {
+	gs := NewGameServer(zap.NewNop(), "", nil)
+	player := newPlayer(game.NewID())
+	connect := func() {
+		conn, client := net.Pipe()
+		t.Cleanup(func() { _ = client.Close() })
+		player.connect(newWire(conn))
+	}
+	connect()
+	g := &Game{ID: game.NewID()}
+	player.AddGame(g)
+	in, _ := player.inbox(g.ID)
+	receive := func() (*PlayMove, error) {
+		t.Helper()
+		type result struct {
+			move *PlayMove
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			move, err := gs.ReceiveMove(player, g.ID)
+			if errors.Is(err, ErrDisconnected) {
+				if err = gs.AwaitReconnect(player, g.ID); err == nil {
+					err = ErrDisconnected
+				}
+			}
+			done <- result{move, err}
+		}()
+		select {
+		case r := <-done:
+			return r.move, r.err
+		case <-time.After(time.Second):
+			t.Fatal("партия не получила ни хода, ни известия о переподключении")
+			return nil, nil
+		}
+	}
+
+	move := moves(1)[0]
+	in.moves <- &move
+	if _, err := receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ход, отправленный до обрыва, приходит раньше известия о нём
+	in.moves <- &move
+	lost, _, _ := player.link()
+	close(lost)
+	connect()
+	if got, err := receive(); err != nil || got != &move {
+		t.Fatalf("получен ход %+v, ошибка %v", got, err)
+	}
+	if _, err := receive(); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("получено %v вместо известия о переподключении", err)
+	}
+
+	// После известия ходы по новому соединению принимаются как обычно
+	in.moves <- &move
+	if got, err := receive(); err != nil || got != &move {
+		t.Fatalf("получен ход %+v, ошибка %v", got, err)
+	}
+}
+
+// connectWithin подключает клиента c к серверу, не дожидаясь дольше секунды.
+func connectWithin(t *testing.T, c *GameClient) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("подключение не завершилось")
+	}
+}
+
+func TestMatchmaking(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer listener.Close()
+	defer cancel()
+	ss := &scriptedServer{turns: 2}
+	ss.gs = NewGameServer(zap.NewNop(), listener.Addr().String(), ss)
+	ss.gs.Serve(ctx, listener)
+
+	// Клиент, не начавший рукопожатие, не задерживает остальных
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// Игрок, потерявший соединение в очереди, соперником не становится
+	dropped := NewGameClient(zap.NewNop(), listener.Addr().String(), &replyingClient{})
+	connectWithin(t, dropped)
+	_ = dropped.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if player, err := ss.gs.GetPlayer(dropped.ID); err == nil && !player.online() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("сервер не заметил обрыв соединения")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clients := make([]*replyingClient, 2)
+	done := make(chan error, len(clients))
+	for i := range clients {
+		clients[i] = &replyingClient{finished: map[game.ID]int{}}
+		clients[i].gc = NewGameClient(zap.NewNop(), listener.Addr().String(), clients[i])
+		connectWithin(t, clients[i].gc)
+		defer clients[i].gc.Close()
+		c := clients[i]
+		go func() {
+			done <- c.gc.HandleUpdates(ctx)
+		}()
+	}
+	for range clients {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("партия не завершилась")
+		}
+	}
+
+	ss.gs.wg.Wait()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ids := [2]game.ID{clients[0].gc.ID, clients[1].gc.ID}
+	if len(ss.pairs) != 1 || ss.pairs[0] != ids && ss.pairs[0] != [2]game.ID{ids[1], ids[0]} {
+		t.Fatalf("созданы партии %v", ss.pairs)
+	}
+}
+
+// forfeitServer засчитывает поражение первому игроку партии, как только
+// соединение с ним потеряно, не дожидаясь его возвращения.
+type forfeitServer struct {
+	gs *GameServer
+}
+
+func (s *forfeitServer) CreateNewGame(first, second *Player) (*Game, error) {
+	return &Game{ID: game.NewID(), Players: []game.ID{first.ID, second.ID}}, nil
+}
+
+func (s *forfeitServer) StartGame(ctx context.Context, g *Game) error {
+	players := make([]*Player, 2)
+	for i, id := range g.Players {
+		player, err := s.gs.GetPlayer(id)
+		if err != nil {
+			return err
+		}
+		players[i] = player
+	}
+	if _, err := s.gs.ReceiveMove(players[0], g.ID); !errors.Is(err, ErrDisconnected) {
+		return fmt.Errorf("получено %v вместо обрыва соединения", err)
+	}
+	for i, player := range players {
+		su := &StatusUpdate{GameID: g.ID, GameFinished: &GameFinished{Winer: i == 1, Reason: ReasonDisconnect}}
+		if err := s.gs.SendStatusUpdate(player, su); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *forfeitServer) UpdateGameState(*Game, *game.Move) (*StatusUpdate, error) {
+	return nil, nil
+}
+
+func TestResultAfterForfeit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer listener.Close()
+	defer cancel()
+	ss := &forfeitServer{}
+	ss.gs = NewGameServer(zap.NewNop(), listener.Addr().String(), ss)
+	ss.gs.Serve(ctx, listener)
+
+	clients := make([]*replyingClient, 2)
+	for i := range clients {
+		clients[i] = &replyingClient{finished: map[game.ID]int{}}
+		clients[i].gc = NewGameClient(zap.NewNop(), listener.Addr().String(), clients[i])
+		clients[i].gc.ReconnectTimeout = 0
+		connectWithin(t, clients[i].gc)
+		defer clients[i].gc.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if player, err := ss.gs.GetPlayer(clients[0].gc.ID); err == nil && player.HasGames() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("партия не началась")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Первый игрок отключается, и партия заканчивается без него
+	_ = clients[0].gc.Close()
+	if err = clients[1].gc.HandleUpdates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ss.gs.wg.Wait()
+
+	// Вернувшись, игрок получает итог вместо подбора новой партии
+	connectWithin(t, clients[0].gc)
+	done := make(chan error, 1)
+	go func() {
+		done <- clients[0].gc.HandleUpdates(ctx)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("итог партии не доставлен")
+	}
+	if len(clients[0].finished) != 1 {
+		t.Fatalf("получены итоги %v", clients[0].finished)
+	}
+}
+
+// playGames сводит двух игроков в games партий по turns ходов и проверяет,
+// что все партии сыграны полностью. Первый игрок обрывает соединение на
+// ходе dropAt, если он не нулевой; before вызывается для него после
+// подключения.
+func playGames(t *testing.T, games, turns, dropAt int, before func(*GameClient)) []*replyingClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer listener.Close()
+	defer cancel()
+
+	ss := &scriptedServer{turns: turns}
+	ss.gs = NewGameServer(zap.NewNop(), listener.Addr().String(), ss)
+	ss.gs.Serve(ctx, listener)
+
+	clients := make([]*replyingClient, 2)
+	for i := range clients {
+		clients[i] = &replyingClient{finished: map[game.ID]int{}}
+		clients[i].gc = NewGameClient(zap.NewNop(), listener.Addr().String(), clients[i])
+		clients[i].gc.Games = games
+		clients[i].gc.ReconnectTimeout = time.Second
+		if err := clients[i].gc.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].gc.Close()
+	}
+	clients[0].dropAt = dropAt
+	before(clients[0].gc)
+
+	done := make(chan error, len(clients))
+	for _, c := range clients {
+		c := c
+		go func() {
+			done <- c.gc.HandleUpdates(ctx)
+		}()
+	}
+	for range clients {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("партии не завершились")
+		}
+	}
+
+	ss.gs.wg.Wait()
+	ss.mu.Lock()
+	if ss.finished != games || len(ss.errs) > 0 {
+		t.Fatalf("завершено партий: %d, ошибки: %v", ss.finished, ss.errs)
+	}
+	ss.mu.Unlock()
+	for i, c := range clients {
+		c.mu.Lock()
+		if len(c.finished) != games || len(c.errs) > 0 {
+			t.Fatalf("игрок %d: завершены партии %v, ошибки %v", i, c.finished, c.errs)
+		}
+		for id, count := range c.finished {
+			if count != turns {
+				t.Fatalf("игрок %d: в партии %v сделано %d ходов из %d", i, id, count, turns)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return clients
+}
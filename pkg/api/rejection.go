@@ -0,0 +1,49 @@
+package api
+
+import (
+	"errors"
+	"hive/pkg/game"
+)
+
+const (
+	// RejectIllegalMove — код отклонения хода, причина которого не распознана.
+	RejectIllegalMove = "illegal_move"
+	// RejectAbortNotAllowed — игрок пытается прервать партию после своего первого хода.
+	RejectAbortNotAllowed = "abort_not_allowed"
+	// RejectTakebackNotAllowed — отмену хода запросили не в свою очередь
+	// или до того, как соперник ответил на ход запросившего игрока.
+	RejectTakebackNotAllowed = "takeback_not_allowed"
+	// RejectUnknownGame — ход отправлен в партию, в которой игрок не участвует.
+	RejectUnknownGame = "unknown_game"
+)
+
+var rejectionCodes = []struct {
+	err  error
+	code string
+}{
+	{game.ErrGameOver, "game_over"},
+	{game.ErrInvalidMove, "invalid_move"},
+	{game.ErrNotYourTurn, "not_your_turn"},
+	{game.ErrNotYourPiece, "not_your_piece"},
+	{game.ErrPieceNotFound, "piece_not_found"},
+	{game.ErrPieceCovered, "piece_covered"},
+	{game.ErrPieceNotInHand, "piece_not_in_hand"},
+	{game.ErrQueenNotPlaced, "queen_not_placed"},
+	{game.ErrQueenRequired, "queen_required"},
+	{game.ErrQueenFirst, "queen_first"},
+	{game.ErrOpeningRestricted, "opening_restricted"},
+	{game.ErrPiecePinned, "piece_pinned"},
+	{game.ErrPieceFrozen, "piece_frozen"},
+	{game.ErrIllegalDestination, "illegal_destination"},
+	{game.ErrPassNotAllowed, "pass_not_allowed"},
+}
+
+// RejectionCode возвращает код MoveRejected для ошибки проверки хода.
+func RejectionCode(err error) string {
+	for _, rejection := range rejectionCodes {
+		if errors.Is(err, rejection.err) {
+			return rejection.code
+		}
+	}
+	return RejectIllegalMove
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"hive/pkg/api"
 	"hive/pkg/game"
@@ -15,22 +17,97 @@ type Client struct {
 	engine         Engine
 	engineStarted  bool
 	engineResponse chan *game.Move
+	takeback       chan struct{}
+	// interrupt прерывает ожидание хода движка после действия игрока
+	interrupt chan struct{}
+	// stopWaiting прерывает ожидание хода движка на предыдущее состояние
+	// партии и дожидается его окончания; nil — ожидания нет
+	stopWaiting func()
+
+	// gameID — партия, которую ведёт клиент; нулевое значение — партии нет
+	gameMu sync.Mutex
+	gameID game.ID
 }
 
+// Engine выбирает ходы игрока по правилам партии rules. После отмены ходов
+// Update может сообщить меньший номер хода, чем в предыдущем состоянии.
 type Engine interface {
-	Start(ctx context.Context, board *game.Board, hand, opponentHand *game.Hand, engineResponse chan *game.Move)
+	Start(ctx context.Context, rules game.Rules, board *game.Board, hand, opponentHand *game.Hand, turn int, engineResponse chan *game.Move)
 	Update(board *game.Board, hand, opponentHand *game.Hand, turn int)
 }
 
+// TakebackHandler реализуют движки, которые решают, согласиться ли на
+// запрос соперника отменить его последний ход. Запросы к движкам без этого
+// интерфейса отклоняются.
+type TakebackHandler interface {
+	AcceptTakeback(board *game.Board, hand, opponentHand *game.Hand, turn int) bool
+}
+
+// MoveRejectionHandler реализуют движки, которым нужно знать, что их ход
+// отклонён сервером. Вслед за отклонением сервер повторно присылает
+// прежнее состояние, и движок получает его через Update.
+type MoveRejectionHandler interface {
+	RejectMove(move *game.Move, reason string)
+}
+
+// ClockHandler реализуют движки, которые показывают часы партии. UpdateClocks
+// вызывается перед каждым ходом игрока с оставшимся временем обеих сторон.
+type ClockHandler interface {
+	UpdateClocks(time, opponentTime time.Duration)
+}
+
+// DrawHandler реализуют движки, которые показывают игроку предложение
+// ничьей и отказ соперника от предложенной ничьей. Ответ на предложение
+// передаётся позже через ActionAcceptDraw или ActionDeclineDraw, ход игрока
+// также отклоняет его. Предложения движкам без этого интерфейса отклоняются.
+type DrawHandler interface {
+	DrawOffered()
+	DrawDeclined()
+}
+
+// LastMoveHandler реализуют движки, которые восстанавливают сессию по
+// состоянию и должны знать фигуру, сходившую последней. LastMoved
+// вызывается перед Start и Update.
+type LastMoveHandler interface {
+	LastMoved(id *game.PieceID)
+}
+
+// FinishHandler реализуют движки, которые показывают итог партии.
+type FinishHandler interface {
+	Finish(finished *api.GameFinished)
+}
+
+// Action — действие игрока вне очереди ходов.
+type Action int
+
+const (
+	ActionResign Action = iota
+	ActionOfferDraw
+	ActionAcceptDraw
+	ActionDeclineDraw
+	ActionAbort
+)
+
+// ActionEngine реализуют движки, через которые игрок может сдаться,
+// предложить ничью, ответить на предложение или прервать партию.
+type ActionEngine interface {
+	Actions() <-chan Action
+}
+
 func NewClient(l *zap.Logger, apiEndpoint string, engine Engine) *Client {
 	client := &Client{
 		log:            l,
 		engine:         engine,
 		engineStarted:  false,
 		engineResponse: make(chan *game.Move, 1),
+		takeback:       make(chan struct{}, 1),
+		interrupt:      make(chan struct{}, 1),
 	}
 
 	client.api = api.NewGameClient(l, apiEndpoint, client)
+	// У клиента один движок и одна текущая партия, поэтому одновременно
+	// он играет только одну партию
+	client.api.Games = 1
 	return client
 }
 
@@ -42,6 +119,12 @@ func (c *Client) Start(ctx context.Context) {
 	}
 	c.log.Info("Успешное присоединение к игре", zap.String("ID", c.api.ID.String()))
 
+	if engine, ok := c.engine.(ActionEngine); ok {
+		actionCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go c.handleActions(actionCtx, engine.Actions())
+	}
+
 	err = c.api.HandleUpdates(ctx)
 	if err != nil {
 		c.log.Error("Ошибка игровой сессии", zap.Error(err))
@@ -56,26 +139,240 @@ func (c *Client) Start(ctx context.Context) {
 	c.log.Info("Успешное завершение игры")
 }
 
+// SetRules выбирает вариант правил, по которому игрок хочет играть.
+// Вызывается до Start; сервер подберёт соперника с тем же вариантом.
+func (c *Client) SetRules(rules game.Rules) {
+	c.api.Rules = &rules
+}
+
+// RequestTakeback просит соперника разрешить отменить последний ход игрока.
+// Запрос отправляется вместо следующего хода, выбранного движком.
+func (c *Client) RequestTakeback() {
+	select {
+	case c.takeback <- struct{}{}:
+	default:
+	}
+}
+
+// Resign сдаёт партию.
+func (c *Client) Resign() {
+	c.act(api.PlayMove{Resign: &api.Resign{}})
+}
+
+// OfferDraw предлагает сопернику ничью.
+func (c *Client) OfferDraw() {
+	c.act(api.PlayMove{DrawOffer: &api.DrawOffer{}})
+}
+
+// ReplyDraw отвечает на предложение ничьей соперника.
+func (c *Client) ReplyDraw(accepted bool) {
+	c.act(api.PlayMove{DrawReply: &api.DrawReply{Accepted: accepted}})
+}
+
+// Abort прерывает партию, пока игрок не сделал свой первый ход.
+func (c *Client) Abort() {
+	c.act(api.PlayMove{Abort: &api.Abort{}})
+}
+
+// act отправляет действие игрока сразу, не дожидаясь хода движка. Если
+// сейчас очередь игрока, ожидание хода прерывается: партия закончится
+// или сервер пришлёт её состояние повторно.
+func (c *Client) act(move api.PlayMove) {
+	c.gameMu.Lock()
+	move.GameID = c.gameID
+	c.gameMu.Unlock()
+	if move.GameID == (game.ID{}) {
+		c.log.Info("Действие вне партии не отправлено", zap.Any("action", move))
+		return
+	}
+
+	if err := c.api.SendMove(move); err != nil {
+		c.log.Error("Ошибка при отправке действия", zap.Error(err))
+		return
+	}
+	c.log.Info("Действие отправлено", zap.Any("action", move))
+	select {
+	case c.interrupt <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) handleActions(ctx context.Context, actions <-chan Action) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case action := <-actions:
+			switch action {
+			case ActionResign:
+				c.Resign()
+			case ActionOfferDraw:
+				c.OfferDraw()
+			case ActionAcceptDraw:
+				c.ReplyDraw(true)
+			case ActionDeclineDraw:
+				c.ReplyDraw(false)
+			case ActionAbort:
+				c.Abort()
+			}
+		}
+	}
+}
+
+// HandleStatusUpdate не ждёт хода движка: ход отправляется из отдельной
+// горутины, чтобы уведомления о ничьей и отмене хода, пришедшие, пока
+// игрок думает, обрабатывались сразу.
 func (c *Client) HandleStatusUpdate(ctx context.Context, su *api.StatusUpdate) error {
+	c.gameMu.Lock()
+	current := c.gameID
+	if current == (game.ID{}) {
+		c.gameID = su.GameID
+	}
+	if su.GameID == c.gameID && (su.GameFinished != nil || su.GameFailed != nil) {
+		c.gameID = game.ID{}
+	}
+	c.gameMu.Unlock()
+	if current != (game.ID{}) && current != su.GameID {
+		c.log.Warn("Обновление другой партии пропущено", zap.Any("game", su.GameID), zap.Any("current", current))
+		return nil
+	}
+
+	if su.GameFinished != nil || su.GameFailed != nil {
+		c.waitDone()
+	}
+	if finished := su.GameFinished; finished != nil {
+		c.log.Info("Игра завершена", zap.Bool("winner", finished.Winer), zap.Bool("tie", finished.Tie),
+			zap.String("reason", finished.Reason), zap.Int("moves", finished.MoveCount), zap.Strings("record", finished.Moves))
+		if handler, ok := c.engine.(FinishHandler); ok {
+			handler.Finish(finished)
+		}
+		return nil
+	}
+	if su.GameFailed != nil {
+		c.log.Info("Ошибка сессии", zap.String("error", su.GameFailed.Error))
+		return nil
+	}
+	if su.TakebackOffer != nil {
+		return c.replyTakeback(su)
+	}
+	if su.TakebackReply != nil {
+		c.log.Info("Ответ на запрос отмены хода", zap.Bool("accepted", su.TakebackReply.Accepted))
+	}
+	if su.DrawOffer != nil {
+		c.drawOffered()
+	}
+	if su.DrawReply != nil {
+		c.log.Info("Соперник отказался от ничьей")
+		if handler, ok := c.engine.(DrawHandler); ok {
+			handler.DrawDeclined()
+		}
+	}
+	if su.GameState == nil {
+		return nil
+	}
+	c.waitDone()
+	// Действие, сделанное до этого состояния, уже учтено сервером
+	select {
+	case <-c.interrupt:
+	default:
+	}
+
+	// После падения флажка ход уже не нужен: сервер пришлёт итог партии
+	wait, cancel := context.WithCancel(ctx)
+	if clocks := su.GameState.Clocks; clocks != nil {
+		if handler, ok := c.engine.(ClockHandler); ok {
+			handler.UpdateClocks(clocks.Time, clocks.OpponentTime)
+		}
+		cancel()
+		wait, cancel = context.WithTimeout(ctx, clocks.Time)
+	}
+
+	if handler, ok := c.engine.(LastMoveHandler); ok {
+		handler.LastMoved(su.GameState.LastMoved)
+	}
 	if !c.engineStarted {
+		rules := game.Rules{}
+		if su.Rules != nil {
+			rules = *su.Rules
+		}
 		go func() {
-			c.engine.Start(ctx, su.GameState.Board, su.GameState.Hand, su.GameState.OpponentHand, c.engineResponse)
+			c.engine.Start(ctx, rules, su.GameState.Board, su.GameState.Hand, su.GameState.OpponentHand, su.GameState.Turn, c.engineResponse)
 		}()
 		c.engineStarted = true
 	} else {
 		c.engine.Update(su.GameState.Board, su.GameState.Hand, su.GameState.OpponentHand, su.GameState.Turn)
 	}
-	// ctx, _ = context.WithTimeout(ctx, 30*time.Second)
 
+	done := make(chan struct{})
+	c.stopWaiting = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		defer cancel()
+		if err := c.awaitMove(wait, su.GameID); err != nil {
+			c.log.Error("Ошибка при отправке хода", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// waitDone прерывает ожидание хода движка на предыдущее состояние партии.
+func (c *Client) waitDone() {
+	if c.stopWaiting != nil {
+		c.stopWaiting()
+		c.stopWaiting = nil
+	}
+}
+
+// awaitMove ждёт ход движка и отправляет его серверу. Ожидание
+// прерывается действием игрока, новым состоянием партии или по истечении
+// времени на ход.
+func (c *Client) awaitMove(wait context.Context, gameID game.ID) error {
 	select {
-	case <-ctx.Done():
+	case <-wait.Done():
+		return nil
+	case <-c.interrupt:
 		return nil
 	case move := <-c.engineResponse:
-		err := c.api.SendMove(api.PlayMove{GameID: su.GameID, Move: move})
-		c.log.Info("Ход отправлен:", zap.Any("move", move))
-		if err != nil {
-			return err
+		select {
+		case <-c.takeback:
+			c.log.Info("Запрошена отмена хода")
+			return c.api.SendMove(api.PlayMove{GameID: gameID, Takeback: &api.TakebackRequest{}})
+		default:
 		}
+		err := c.api.SendMove(api.PlayMove{GameID: gameID, Move: move})
+		c.log.Info("Ход отправлен:", zap.Any("move", move))
+		return err
+	}
+}
+
+func (c *Client) HandleMoveRejected(ctx context.Context, rejected *api.MoveRejected) error {
+	c.log.Info("Ход отклонён сервером", zap.Any("move", rejected.Move), zap.String("code", rejected.Code),
+		zap.String("reason", rejected.Message), zap.Int("attempts_left", rejected.AttemptsLeft))
+	if handler, ok := c.engine.(MoveRejectionHandler); ok {
+		handler.RejectMove(rejected.Move, rejected.Message)
 	}
 	return nil
 }
+
+func (c *Client) drawOffered() {
+	handler, ok := c.engine.(DrawHandler)
+	c.log.Info("Соперник предлагает ничью", zap.Bool("handled", ok))
+	if !ok {
+		c.ReplyDraw(false)
+		return
+	}
+	handler.DrawOffered()
+}
+
+func (c *Client) replyTakeback(su *api.StatusUpdate) error {
+	accepted := false
+	if handler, ok := c.engine.(TakebackHandler); ok {
+		state := su.GameState
+		accepted = handler.AcceptTakeback(state.Board, state.Hand, state.OpponentHand, state.Turn)
+	}
+	c.log.Info("Запрос отмены хода от соперника", zap.Bool("accepted", accepted))
+	return c.api.SendMove(api.PlayMove{GameID: su.GameID, TakebackReply: &api.TakebackReply{Accepted: accepted}})
+}
@@ -2,10 +2,15 @@ package engine
 
 import (
 	"context"
+	"fmt"
+	"hive/pkg/api"
+	"hive/pkg/client"
 	"hive/pkg/game"
 	"math"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/veandco/go-sdl2/gfx"
 	"github.com/veandco/go-sdl2/img"
@@ -22,6 +27,8 @@ const (
 	imageResizeCoefficient = 1.6
 	handFontSize           = 20
 	handCircleSize         = 11
+	buttonWidth            = 200
+	buttonHeight           = 36
 	fontPath               = "../assets/NotoSans-Regular.ttf"
 )
 
@@ -43,8 +50,29 @@ type UserEngine struct {
 	handFont          *ttf.Font
 	renderMu          sync.Mutex
 	turn              int
+	rules             game.Rules
 	selectedHandPiece int
 	selectedPiece     *game.Piece
+	mustPass          bool
+	// legalMoves — допустимые ходы игрока в текущей позиции, в том числе
+	// броски фигур соперника мокрицей; lastMoved — фигура, сходившая
+	// последней
+	legalMoves []game.Move
+	lastMoved  *game.PieceID
+	// notice — сообщение игроку, например причина отклонения хода
+	notice string
+	// timed — партия идёт с часами; clock и opponentClock — время сторон
+	// на момент clockSince. Пока игрок думает, идут его часы, после хода —
+	// часы соперника
+	timed         bool
+	clock         time.Duration
+	opponentClock time.Duration
+	clockSince    time.Time
+	// actions передаёт клиенту действия игрока; drawOffer — соперник
+	// предложил ничью, drawOffered — игрок уже предложил её в этот ход
+	actions     chan client.Action
+	drawOffer   bool
+	drawOffered bool
 }
 
 func MakeUserEngine(logger *zap.Logger, title string) *UserEngine {
@@ -58,6 +86,9 @@ func MakeUserEngine(logger *zap.Logger, title string) *UserEngine {
 			game.Beetle:      "../assets/beetle.png",
 			game.Grasshopper: "../assets/grasshopper.png",
 			game.SoldierAnt:  "../assets/ant.png",
+			game.Mosquito:    "../assets/mosquito.png",
+			game.Ladybug:     "../assets/ladybug.png",
+			game.Pillbug:     "../assets/pillbug.png",
 		},
 		insectColor: map[game.PieceType]sdl.Color{
 			game.QueenBee:    {R: 243, G: 218, B: 11, A: 255},
@@ -65,10 +96,14 @@ func MakeUserEngine(logger *zap.Logger, title string) *UserEngine {
 			game.Beetle:      {R: 83, G: 55, B: 122, A: 255},
 			game.Grasshopper: {R: 68, G: 148, B: 74, A: 255},
 			game.SoldierAnt:  {R: 28, G: 169, B: 201, A: 255},
+			game.Mosquito:    {R: 96, G: 108, B: 128, A: 255},
+			game.Ladybug:     {R: 206, G: 32, B: 41, A: 255},
+			game.Pillbug:     {R: 64, G: 173, B: 158, A: 255},
 		},
 		insectImgSurfaces: make(map[game.PieceType]*sdl.Surface),
 		renderMu:          sync.Mutex{},
 		selectedHandPiece: -1,
+		actions:           make(chan client.Action, 1),
 	}
 }
 
@@ -142,7 +177,11 @@ func (ue *UserEngine) Destroy() {
 func (ue *UserEngine) DrawBoard(mouseX, mouseY int, isClicking bool, shiftX, shiftY float64) (selectedPosition *game.Position, selectEmptyRoom bool) {
 	_hexRadius := hexBoardRadius * imageResizeCoefficient
 
-	for _, piece := range ue.board.Pieces {
+	// Фигуры рисуются снизу вверх, чтобы жук на вершине стопки перекрывал накрытые им фигуры
+	pieces := append([]*game.Piece{}, ue.board.Pieces...)
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].Level < pieces[j].Level })
+
+	for _, piece := range pieces {
 		centerX := windowWidth/2 + float64(piece.Position.X-piece.Position.Y)*_hexRadius*1.5 + shiftX
 		centerY := windowHeight/2 + float64(piece.Position.X+piece.Position.Y)*_hexRadius*math.Sqrt(3)/2 + shiftY
 
@@ -161,9 +200,9 @@ func (ue *UserEngine) DrawBoard(mouseX, mouseY int, isClicking bool, shiftX, shi
 		}
 		gfx.FilledPolygonColor(ue.render, vx, vy, pieceColor)
 
-		placeQueen := ue.turn >= 6 && ue.hand.Pieces[game.QueenBee] != 0
-
-		if !placeQueen && mouseX != -1 && mouseY != -1 && piece.Color == ue.color {
+		// Выбрать можно фигуру, у которой есть допустимые ходы: свою или
+		// фигуру соперника, которую может бросить мокрица
+		if mouseX != -1 && mouseY != -1 && ue.movable(piece) {
 			if ue.pointInsidePolygon(int16(mouseX), int16(mouseY), vx, vy) {
 				gfx.FilledPolygonColor(ue.render, vx, vy, sdl.Color{R: 60, G: 60, B: 60, A: 20})
 				if isClicking {
@@ -183,10 +222,19 @@ func (ue *UserEngine) DrawBoard(mouseX, mouseY int, isClicking bool, shiftX, shi
 	var possibleMoves []game.Position
 	var color sdl.Color
 	if ue.selectedHandPiece != -1 {
-		possibleMoves = game.AvailableToPlace(ue.board, ue.color)
-		color = ue.insectColor[ue.pieceTypes[ue.selectedHandPiece]]
+		pieceType := ue.pieceTypes[ue.selectedHandPiece]
+		for _, move := range ue.legalMoves {
+			if !move.Pass && ue.board.Piece(move.Piece) == nil && move.Piece.Type == pieceType {
+				possibleMoves = append(possibleMoves, *move.Position)
+			}
+		}
+		color = ue.insectColor[pieceType]
 	} else if ue.selectedPiece != nil {
-		possibleMoves = game.AvailableToMove(ue.board, ue.selectedPiece)
+		for _, move := range ue.legalMoves {
+			if !move.Pass && move.Piece == ue.selectedPiece.ID() {
+				possibleMoves = append(possibleMoves, *move.Position)
+			}
+		}
 		color = ue.insectColor[ue.selectedPiece.Type]
 	} else {
 		return selectedPosition, selectEmptyRoom
@@ -267,7 +315,7 @@ func (ue *UserEngine) DrawHand(mouseX, mouseY int, isClicking bool) (selectedPie
 		}
 		gfx.FilledPolygonColor(ue.render, vx, vy, pieceColor)
 
-		placeQueen := ue.turn >= 6 && ue.hand.Pieces[game.QueenBee] != 0
+		placeQueen := ue.rules.QueenRequired(ue.turn, ue.hand)
 
 		if placeQueen && ue.pieceTypes[i] == game.QueenBee || !placeQueen && ue.hand.Pieces[ue.pieceTypes[i]] > 0 {
 			var color sdl.Color = ue.insectColor[ue.pieceTypes[i]]
@@ -316,6 +364,114 @@ func (ue *UserEngine) DrawHand(mouseX, mouseY int, isClicking bool) (selectedPie
 	return selectedPiece
 }
 
+// DrawPassButton рисует кнопку пропуска хода и сообщает, была ли она нажата.
+func (ue *UserEngine) DrawPassButton(mouseX, mouseY int, isClicking bool) (pressed bool) {
+	return ue.drawButton("Пропустить ход", windowWidth-buttonWidth-10, windowHeight/2-buttonHeight/2, mouseX, mouseY, isClicking)
+}
+
+type actionButton struct {
+	text   string
+	action client.Action
+}
+
+// DrawActionButtons рисует под кнопкой пропуска хода кнопки действий игрока
+// и сообщает, какая из них нажата.
+func (ue *UserEngine) DrawActionButtons(mouseX, mouseY int, isClicking bool) (action client.Action, pressed bool) {
+	var buttons []actionButton
+	switch {
+	case ue.drawOffer:
+		buttons = append(buttons, actionButton{"Принять ничью", client.ActionAcceptDraw}, actionButton{"Отклонить ничью", client.ActionDeclineDraw})
+	case !ue.drawOffered:
+		buttons = append(buttons, actionButton{"Предложить ничью", client.ActionOfferDraw})
+	}
+	// Прервать партию можно до своего первого хода
+	if ue.turn < 2 {
+		buttons = append(buttons, actionButton{"Прервать", client.ActionAbort})
+	} else {
+		buttons = append(buttons, actionButton{"Сдаться", client.ActionResign})
+	}
+
+	x := windowWidth - buttonWidth - 10
+	y := windowHeight/2 + buttonHeight/2 + 10
+	for _, button := range buttons {
+		if ue.drawButton(button.text, x, y, mouseX, mouseY, isClicking) {
+			action, pressed = button.action, true
+		}
+		y += buttonHeight + 10
+	}
+	return action, pressed
+}
+
+func (ue *UserEngine) drawButton(text string, x, y, mouseX, mouseY int, isClicking bool) (pressed bool) {
+	color := sdl.Color{R: 220, G: 220, B: 220, A: 255}
+	if mouseX >= x && mouseX < x+buttonWidth && mouseY >= y && mouseY < y+buttonHeight {
+		color = sdl.Color{R: 190, G: 190, B: 190, A: 255}
+		pressed = isClicking
+	}
+	gfx.BoxColor(ue.render, int32(x), int32(y), int32(x+buttonWidth), int32(y+buttonHeight), color)
+
+	w, h, err := ue.handFont.SizeUTF8(text)
+	if err != nil {
+		panic(err)
+	}
+	ue.drawText(text, x+(buttonWidth-w)/2, y+(buttonHeight-h)/2, sdl.Color{R: 60, G: 60, B: 60, A: 255})
+	return pressed
+}
+
+// DrawClocks рисует часы соперника под его рукой и часы игрока над своей.
+func (ue *UserEngine) DrawClocks() {
+	if !ue.timed {
+		return
+	}
+	clock, opponentClock := ue.clock, ue.opponentClock
+	if ue.active {
+		clock -= time.Since(ue.clockSince)
+	} else {
+		opponentClock -= time.Since(ue.clockSince)
+	}
+
+	handHeight := int(2 * hexHandRadius * imageResizeCoefficient)
+	textColor := sdl.Color{R: 60, G: 60, B: 60, A: 255}
+	for _, c := range []struct {
+		left time.Duration
+		y    int
+	}{
+		{opponentClock, handHeight + 10},
+		{clock, windowHeight - handHeight - 10},
+	} {
+		text := formatClock(c.left)
+		w, h, err := ue.handFont.SizeUTF8(text)
+		if err != nil {
+			panic(err)
+		}
+		y := c.y
+		if c.y > windowHeight/2 {
+			y -= h
+		}
+		ue.drawText(text, windowWidth-w-10, y, textColor)
+	}
+}
+
+func formatClock(left time.Duration) string {
+	if left < 0 {
+		left = 0
+	}
+	seconds := int(left.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// DrawNotice выводит сообщение игроку над кнопкой пропуска хода.
+func (ue *UserEngine) DrawNotice() {
+	if ue.notice == "" {
+		return
+	}
+	_, h, err := ue.handFont.SizeUTF8(ue.notice)
+	if err != nil {
+		panic(err)
+	}
+	ue.drawText(ue.notice, 10, windowHeight/2-buttonHeight/2-h-10, sdl.Color{R: 150, G: 20, B: 20, A: 255})
+}
+
 func (ue *UserEngine) DrawOpponentHand() {
 	_hexRadius := hexHandRadius * imageResizeCoefficient
 
@@ -371,20 +527,23 @@ func (ue *UserEngine) DrawOpponentHand() {
 	}
 }
 
-func (ue *UserEngine) Start(ctx context.Context, board *game.Board, hand, opponentHand *game.Hand, engineResponse chan *game.Move) {
+func (ue *UserEngine) Start(ctx context.Context, rules game.Rules, board *game.Board, hand, opponentHand *game.Hand, turn int, engineResponse chan *game.Move) {
 	ue.renderMu.Lock()
+	ue.rules = rules
 	ue.board = board
 	ue.hand = hand
 	ue.opponentHand = opponentHand
+	ue.turn = turn
 	ue.color = ue.hand.Color
 	ue.active = true
+	ue.updateMoves()
 	ue.renderMu.Unlock()
 
 	if !ue.init {
 		ue.Init()
 	}
 
-	for _, pt := range []game.PieceType{game.QueenBee, game.Spider, game.Beetle, game.Grasshopper, game.SoldierAnt} {
+	for _, pt := range game.PieceTypes {
 		if _, ok := (ue.hand.Pieces)[pt]; ok {
 			ue.pieceTypes = append(ue.pieceTypes, pt)
 		}
@@ -471,6 +630,8 @@ func (ue *UserEngine) Start(ctx context.Context, board *game.Board, hand, oppone
 			ue.render.Clear()
 
 			ue.DrawOpponentHand()
+			ue.DrawClocks()
+			ue.DrawNotice()
 
 			if ue.active {
 				if !isClicking {
@@ -491,35 +652,71 @@ func (ue *UserEngine) Start(ctx context.Context, board *game.Board, hand, oppone
 					if position != nil {
 						draggingDeactivate = true
 						if selectEmptyRoom {
+							session := ue.session()
 							var movePlayed *game.Move
 							if ue.selectedHandPiece != -1 {
-								piecePlaced := &game.Piece{Position: *position, Type: ue.pieceTypes[ue.selectedHandPiece], Color: ue.color, Placed: false}
-								ue.board.Pieces = append(ue.board.Pieces, piecePlaced)
-								ue.hand.Pieces[ue.pieceTypes[ue.selectedHandPiece]] -= 1
-								movePlayed = &game.Move{Piece: piecePlaced, Position: position}
+								pieceType := ue.pieceTypes[ue.selectedHandPiece]
+								id := game.PieceID{Color: ue.color, Type: pieceType, Number: session.NextNumber(ue.color, pieceType)}
+								movePlayed = &game.Move{Piece: id, Position: position}
 							} else {
-								piece := &game.Piece{Position: ue.selectedPiece.Position, Type: ue.selectedPiece.Type, Color: ue.selectedPiece.Color, Placed: true}
-								movePlayed = &game.Move{Piece: piece, Position: position}
-								(*ue.selectedPiece).Position = *position
+								movePlayed = &game.Move{Piece: ue.selectedPiece.ID(), Position: position}
 							}
 							ue.selectedHandPiece = -1
 							ue.selectedPiece = nil
-							ue.active = false
 							draggingDeactivate = false
-							engineResponse <- movePlayed
+							// Ход применяется к локальной копии доски по тем же правилам, что и на сервере
+							if err := session.ApplyMove(movePlayed); err != nil {
+								ue.log.Info("Недопустимый ход", zap.Error(err))
+							} else {
+								ue.stopClock()
+								ue.notice = ""
+								ue.drawOffer = false
+								ue.drawOffered = false
+								engineResponse <- movePlayed
+							}
 						} else {
 							// ue.log.Info("Position selected", zap.Any("position", position), zap.Any("deck", ue.board.Pieces))
 
-							for _, p := range ue.board.Pieces {
-								if p.Position.X == position.X && p.Position.Y == position.Y {
-									ue.selectedPiece = p
-									break
-								}
-							}
+							ue.selectedPiece = ue.board.TopPiece(*position)
 							ue.selectedHandPiece = -1
 						}
 					}
 				}
+
+				// Кнопка пропуска хода доступна, только если допустимых ходов нет
+				if ue.mustPass {
+					if !isClicking {
+						ue.DrawPassButton(hoverX, hoverY, isClicking)
+					} else if ue.DrawPassButton(startX, startY, isClicking) {
+						ue.mustPass = false
+						ue.stopClock()
+						ue.notice = ""
+						ue.drawOffer = false
+						ue.drawOffered = false
+						draggingDeactivate = false
+						engineResponse <- &game.Move{Pass: true}
+					}
+				}
+
+				// Действие прерывает ожидание хода: сервер завершит партию
+				// или пришлёт её состояние повторно
+				if !isClicking {
+					ue.DrawActionButtons(hoverX, hoverY, isClicking)
+				} else if action, pressed := ue.DrawActionButtons(startX, startY, isClicking); pressed {
+					ue.active = false
+					draggingDeactivate = false
+					switch action {
+					case client.ActionOfferDraw:
+						ue.drawOffered = true
+					case client.ActionAcceptDraw, client.ActionDeclineDraw:
+						ue.drawOffer = false
+					}
+					select {
+					case ue.actions <- action:
+					default:
+					}
+				}
+
 				// Отображение результата на экране
 				ue.render.Present()
 
@@ -550,10 +747,134 @@ func (ue *UserEngine) Update(board *game.Board, hand, opponentHand *game.Hand, t
 	ue.selectedHandPiece = -1
 	ue.selectedPiece = nil
 	ue.active = true
+	ue.updateMoves()
 	ue.window.Raise()
 	ue.renderMu.Unlock()
 }
 
+// UpdateClocks запоминает время сторон перед ходом игрока.
+func (ue *UserEngine) UpdateClocks(clock, opponentClock time.Duration) {
+	ue.renderMu.Lock()
+	ue.timed = true
+	ue.clock = clock
+	ue.opponentClock = opponentClock
+	ue.clockSince = time.Now()
+	ue.renderMu.Unlock()
+}
+
+// stopClock останавливает часы игрока после хода и запускает часы соперника.
+func (ue *UserEngine) stopClock() {
+	ue.active = false
+	if ue.timed {
+		ue.clock -= time.Since(ue.clockSince)
+		ue.clockSince = time.Now()
+	}
+}
+
+// Actions возвращает канал действий игрока: сдачи, предложения ничьей,
+// ответа на него и прерывания партии.
+func (ue *UserEngine) Actions() <-chan client.Action {
+	return ue.actions
+}
+
+// DrawOffered показывает игроку предложение ничьей. Ответить на него
+// можно в свой ход.
+func (ue *UserEngine) DrawOffered() {
+	ue.renderMu.Lock()
+	ue.drawOffer = true
+	ue.notice = "Соперник предлагает ничью"
+	ue.renderMu.Unlock()
+}
+
+func (ue *UserEngine) DrawDeclined() {
+	ue.renderMu.Lock()
+	ue.notice = "Соперник отказался от ничьей"
+	ue.renderMu.Unlock()
+}
+
+var reasonTexts = map[string]string{
+	api.ReasonQueenSurrounded: "королева улья окружена",
+	api.ReasonBothSurrounded:  "окружены обе королевы",
+	api.ReasonRepetition:      "позиция повторилась трижды",
+	api.ReasonRulesInfraction: "нарушение правил",
+	api.ReasonTimeout:         "истекло время",
+	api.ReasonResignation:     "сдача",
+	api.ReasonAgreement:       "по соглашению",
+	api.ReasonDisconnect:      "соперник отключился",
+}
+
+// Finish показывает итоговую позицию и результат партии.
+func (ue *UserEngine) Finish(finished *api.GameFinished) {
+	result := "Поражение"
+	switch {
+	case finished.Reason == api.ReasonAborted:
+		result = "Партия прервана"
+	case finished.Tie:
+		result = "Ничья"
+	case finished.Winer:
+		result = "Победа"
+	}
+	if text, ok := reasonTexts[finished.Reason]; ok {
+		result += ": " + text
+	}
+
+	ue.renderMu.Lock()
+	if finished.Board != nil {
+		ue.board = finished.Board
+	}
+	ue.active = false
+	ue.timed = false
+	ue.notice = fmt.Sprintf("%s, ходов: %d", result, finished.MoveCount)
+	ue.renderMu.Unlock()
+}
+
+// RejectMove показывает игроку причину, по которой сервер отклонил ход.
+// Ход уже применён к локальной доске; её откатывает следующий Update
+// с состоянием сервера.
+func (ue *UserEngine) RejectMove(move *game.Move, reason string) {
+	ue.renderMu.Lock()
+	ue.notice = "Ход отклонён: " + reason
+	ue.renderMu.Unlock()
+}
+
+// LastMoved запоминает фигуру, сходившую последним ходом.
+func (ue *UserEngine) LastMoved(id *game.PieceID) {
+	ue.renderMu.Lock()
+	ue.lastMoved = id
+	ue.renderMu.Unlock()
+}
+
+// session восстанавливает игровую сессию по текущему состоянию движка.
+func (ue *UserEngine) session() *game.GameSession {
+	white, black := ue.hand, ue.opponentHand
+	if ue.color == game.Black {
+		white, black = black, white
+	}
+	session := game.NewGameSessionFromState(ue.rules, ue.board, white, black, ue.turn)
+	session.SetLastMoved(ue.lastMoved)
+	return session
+}
+
+// updateMoves пересчитывает допустимые ходы после нового состояния.
+func (ue *UserEngine) updateMoves() {
+	session := ue.session()
+	ue.legalMoves = session.LegalMoves()
+	ue.mustPass = session.MustPass()
+}
+
+// movable сообщает, есть ли у фигуры на вершине стопки допустимые ходы.
+func (ue *UserEngine) movable(piece *game.Piece) bool {
+	if ue.board.TopPiece(piece.Position) != piece {
+		return false
+	}
+	for _, move := range ue.legalMoves {
+		if !move.Pass && move.Piece == piece.ID() {
+			return true
+		}
+	}
+	return false
+}
+
 func (ue *UserEngine) pointInsidePolygon(x, y int16, verticesX, verticesY []int16) bool {
 	numVertices := len(verticesX)
 	if numVertices != len(verticesY) || numVertices < 3 {
@@ -1,6 +1,6 @@
 package game
 
-import "fmt"
+import "encoding/json"
 
 type Position struct {
 	X int
@@ -16,6 +16,9 @@ const (
 	Grasshopper
 	SoldierAnt
 	// дополнительные типы для расширений
+	Mosquito
+	Ladybug
+	Pillbug
 )
 
 type PieceColor int
@@ -25,327 +28,460 @@ const (
 	Black
 )
 
+func (c PieceColor) Opponent() PieceColor {
+	if c == White {
+		return Black
+	}
+	return White
+}
+
 type Piece struct {
 	Position Position
 	Type     PieceType
 	Color    PieceColor
 	Placed   bool
 	Level    int
+	// Number — порядковый номер фигуры среди фигур того же цвета и типа,
+	// присваивается при размещении: первый выставленный муравей получает 1.
+	Number int
+}
+
+// PieceID однозначно определяет фигуру в партии: цвет, тип и порядковый
+// номер, который фигура получает при размещении и сохраняет до конца партии.
+type PieceID struct {
+	Color  PieceColor
+	Type   PieceType
+	Number int
 }
 
+func (p *Piece) ID() PieceID {
+	return PieceID{Color: p.Color, Type: p.Type, Number: p.Number}
+}
+
+// Board хранит фигуры доски в порядке их размещения. Для быстрого поиска
+// по клеткам доска строит индекс grid, который не сериализуется.
 type Board struct {
 	Pieces []*Piece
+	index  *grid
 }
 
+// UnmarshalJSON декодирует фигуры в новый срез и сбрасывает индекс доски.
+func (b *Board) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Pieces []*Piece
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	b.Pieces = decoded.Pieces
+	b.index = nil
+	return nil
+}
+
+// Move описывает размещение или перемещение фигуры Piece в клетку Position.
+// Если фигуры с таким идентификатором ещё нет на доске, она выставляется
+// из руки. Ход с Pass, равным true, означает пропуск хода и не содержит фигуры.
 type Move struct {
-	Piece    *Piece
+	Piece    PieceID
 	Position *Position
+	Pass     bool
 }
 
-func IsPositionNeignbour(lhs, rhs Position) bool {
-	relative_position := Position{X: lhs.X - rhs.X, Y: lhs.Y - rhs.Y}
-	if relative_position.X == 1 {
-		if relative_position.Y == 0 || relative_position.Y == 1 {
-			return true
-		}
-	} else if relative_position.X == 0 {
-		if relative_position.Y == 1 || relative_position.Y == -1 {
-			return true
-		}
-	} else if relative_position.X == -1 {
-		if relative_position.Y == 0 || relative_position.Y == -1 {
-			return true
+// directions перечисляет смещения к шести соседним клеткам по кругу:
+// соседние элементы массива задают смежные между собой клетки.
+var directions = [6]Position{{1, 0}, {1, 1}, {0, 1}, {-1, 0}, {-1, -1}, {0, -1}}
+
+// gateDirections[i] — индексы направлений к двум клеткам, общим для клетки
+// и её соседа в направлении i.
+var gateDirections = [6][2]int{{5, 1}, {0, 2}, {1, 3}, {2, 4}, {3, 5}, {4, 0}}
+
+// PieceTypes перечисляет типы насекомых в порядке их отображения в руке.
+var PieceTypes = []PieceType{QueenBee, Spider, Beetle, Grasshopper, SoldierAnt, Mosquito, Ladybug, Pillbug}
+
+func (p Position) Add(other Position) Position {
+	return Position{X: p.X + other.X, Y: p.Y + other.Y}
+}
+
+func Neighbours(position Position) []Position {
+	neighbours := position.neighbours()
+	return neighbours[:]
+}
+
+// neighbours возвращает соседние клетки в порядке directions без выделения памяти.
+func (p Position) neighbours() [6]Position {
+	var neighbours [6]Position
+	for i, d := range directions {
+		neighbours[i] = p.Add(d)
+	}
+	return neighbours
+}
+
+// direction возвращает индекс направления от from к соседней клетке to или -1.
+func direction(from, to Position) int {
+	for i, d := range directions {
+		if from.Add(d) == to {
+			return i
 		}
 	}
-	return false
+	return -1
+}
+
+// gates возвращает две клетки, общие для соседних клеток from и to.
+func gates(from, to Position) (Position, Position) {
+	i := direction(from, to)
+	if i < 0 {
+		panic("gates: positions are not neighbours")
+	}
+	return from.Add(directions[gateDirections[i][0]]), from.Add(directions[gateDirections[i][1]])
+}
+
+// canCrawl сообщает, может ли фигура переместиться из from в соседнюю клетку to,
+// если хотя бы одна из них занята: проход между двумя стопками закрыт, если обе
+// они выше и клетки, с которой фигура уходит, и клетки, на которую она попадает.
+func canCrawl(occupied occupancy, from, to Position) bool {
+	lhs, rhs := gates(from, to)
+	gate := occupied.height(lhs)
+	if h := occupied.height(rhs); h < gate {
+		gate = h
+	}
+	height := occupied.height(from)
+	if h := occupied.height(to); h > height {
+		height = h
+	}
+	return gate <= height
+}
+
+// canSlide сообщает, может ли фигура проползти по земле из from в соседнюю
+// клетку to: ровно одна из общих клеток должна быть занята, иначе фигура
+// либо не протиснется между соседями, либо оторвётся от улья.
+func canSlide(occupied occupancy, from, to Position) bool {
+	lhs, rhs := gates(from, to)
+	return occupied.occupied(lhs) != occupied.occupied(rhs)
+}
+
+func IsPositionNeignbour(lhs, rhs Position) bool {
+	return direction(lhs, rhs) >= 0
 }
 
-type Data struct {
-	Level int
-	Color PieceColor
+// TopPiece возвращает верхнюю фигуру стопки в клетке position или nil,
+// если клетка свободна.
+func (b *Board) TopPiece(position Position) *Piece {
+	return b.grid().top(position)
 }
 
+// Piece возвращает фигуру доски с идентификатором id или nil,
+// если такая фигура ещё не выставлена.
+func (b *Board) Piece(id PieceID) *Piece {
+	return b.grid().pieces[id]
+}
+
+// Height возвращает количество фигур в клетке position.
+func (b *Board) Height(position Position) int {
+	return b.grid().height(position)
+}
+
+func IsSurrounded(board *Board, position Position) bool {
+	g := board.grid()
+	for _, neighbour := range position.neighbours() {
+		if g.height(neighbour) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AvailableToPlace возвращает свободные клетки, куда игрок цвета color может
+// выставить фигуру из руки: рядом со своими фигурами и не рядом с фигурами
+// соперника. Цвет стопки определяется её верхней фигурой.
 func AvailableToPlace(board *Board, color PieceColor) []Position {
 	var positions []Position
 	if len(board.Pieces) == 0 {
-		positions = append(positions, Position{0, 0})
-	} else if len(board.Pieces) == 1 {
-		for i := -1; i <= 1; i++ {
-			for j := -1; j <= 1; j++ {
-				if (i != 0 || j != 0) && i+j != 0 {
-					positions = append(positions, Position{i, j})
-				}
-			}
+		return append(positions, Position{0, 0})
+	}
+	if len(board.Pieces) == 1 {
+		return append(positions, Neighbours(board.Pieces[0].Position)...)
+	}
+
+	g := board.grid()
+	checked := map[Position]bool{}
+	// Фигуры перебираются в порядке Pieces, а не по индексу, чтобы порядок
+	// клеток не зависел от обхода map
+	for _, piece := range board.Pieces {
+		if piece.Color != color || g.top(piece.Position) != piece {
+			continue
 		}
-	} else {
-		set := map[Position]Data{}
-		for _, piece := range board.Pieces {
-			if data, ok := set[piece.Position]; ok {
-				if piece.Level > data.Level {
-					set[piece.Position] = Data{piece.Level, piece.Color}
-				}
-			} else {
-				set[piece.Position] = Data{piece.Level, piece.Color}
+		for _, candidate := range piece.Position.neighbours() {
+			if checked[candidate] {
+				continue
 			}
-		}
-
-		for pos := range set {
-			if set[pos].Color == color {
-				for i := -1; i <= 1; i++ {
-					for j := -1; j <= 1; j++ {
-						if (i != 0 || j != 0) && i+j != 0 {
-							checkPosition := Position{pos.X + i, pos.Y + j}
-							positionAvailable := true
-
-							for _, k := range board.Pieces {
-								if checkPosition.X == k.Position.X && checkPosition.Y == k.Position.Y {
-									positionAvailable = false
-									break
-								}
-								if k.Color != color {
-									if IsPositionNeignbour(checkPosition, k.Position) {
-										positionAvailable = false
-										break
-									}
-								}
-							}
-
-							if positionAvailable {
-								positions = append(positions, checkPosition)
-							}
-						}
-					}
+			checked[candidate] = true
+			if g.height(candidate) > 0 {
+				continue
+			}
+			available := true
+			for _, neighbour := range candidate.neighbours() {
+				if top := g.top(neighbour); top != nil && top.Color != color {
+					available = false
+					break
 				}
 			}
+			if available {
+				positions = append(positions, candidate)
+			}
 		}
 	}
 	return positions
 }
 
-func CanSqueezeThrough(board *Board, lhs, rhs Position, exclude *Position, level int) bool {
-	commonNeighbours := 0
-	for _, piece := range board.Pieces {
-		if exclude == nil || (piece.Position.X != exclude.X || piece.Position.Y != exclude.Y) {
-			if IsPositionNeignbour(lhs, piece.Position) && IsPositionNeignbour(rhs, piece.Position) && piece.Level >= level {
-				commonNeighbours += 1
-			}
+// CanMove сообщает, можно ли снять фигуру piece с доски, не разорвав улей.
+// Фигура под другой фигурой двигаться не может, а фигура с вершины стопки
+// не меняет множества занятых клеток.
+func CanMove(board *Board, piece *Piece) bool {
+	g := board.grid()
+	stack := g.stack(piece.Position)
+	if stack[len(stack)-1] != piece {
+		return false
+	}
+	if len(stack) > 1 {
+		return true
+	}
+	h := g.graph()
+	return len(h.cells) > 1 && !h.articulation[h.index[cellOf(piece.Position)]]
+}
+
+// PinnedPieces возвращает фигуры, которые нельзя снять с доски по правилу
+// единого улья, и фигуры, накрытые другими фигурами. Точки сочленения улья
+// находятся за один обход, поэтому это дешевле, чем CanMove для каждой фигуры.
+func PinnedPieces(board *Board) map[*Piece]bool {
+	pinned := map[*Piece]bool{}
+	g := board.grid()
+	h := g.graph()
+	for i, position := range h.cells {
+		stack := g.stack(position)
+		for _, piece := range stack[:len(stack)-1] {
+			pinned[piece] = true
+		}
+		if len(stack) == 1 && (h.articulation[i] || len(h.cells) == 1) {
+			pinned[stack[0]] = true
 		}
 	}
-	return commonNeighbours != 2
+	return pinned
 }
 
-func CanMove(board *Board, piece *Piece) bool {
-	visited := map[Position]bool{}
-	for _, p := range board.Pieces {
-		if p.Position.X != piece.Position.X || p.Position.Y != piece.Position.Y {
-			visited[p.Position] = false
-		} else if p.Level > piece.Level {
-			return false
+func AvailableToMove(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+
+	if CanMove(board, piece) {
+		positions = movesAs(board, piece, piece.Type)
+	}
+	return positions
+}
+
+// movesAs возвращает клетки, куда фигура piece может пойти по правилам
+// насекомого pieceType. Комар пользуется этим, чтобы перенимать ходы соседей.
+func movesAs(board *Board, piece *Piece, pieceType PieceType) []Position {
+	switch pieceType {
+	case QueenBee, Pillbug:
+		return queenMoves(board, piece)
+	case SoldierAnt:
+		return antMoves(board, piece)
+	case Spider:
+		return spiderMoves(board, piece)
+	case Grasshopper:
+		return grasshopperMoves(board, piece)
+	case Beetle:
+		return beetleMoves(board, piece)
+	case Mosquito:
+		return mosquitoMoves(board, piece)
+	case Ladybug:
+		return ladybugMoves(board, piece)
+	}
+	return []Position{}
+}
+
+func queenMoves(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+	occupied := board.occupancy(piece)
+	for _, pos := range piece.Position.neighbours() {
+		if !occupied.occupied(pos) && canSlide(occupied, piece.Position, pos) {
+			positions = append(positions, pos)
 		}
 	}
+	return positions
+}
 
-	if len(visited) > 0 {
-		l1 := &[]Position{}
-		l2 := &[]Position{}
-		for key := range visited {
-			*l1 = append(*l1, key)
-			visited[key] = true
-			break
+// antMoves обходит в ширину все клетки, до которых муравей может доползти вдоль улья.
+func antMoves(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+	occupied := board.occupancy(piece)
+	visited := map[Position]bool{piece.Position: true}
+	queue := []Position{piece.Position}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, pos := range current.neighbours() {
+			if !occupied.occupied(pos) && !visited[pos] && canSlide(occupied, current, pos) {
+				visited[pos] = true
+				positions = append(positions, pos)
+				queue = append(queue, pos)
+			}
 		}
+	}
+	return positions
+}
 
-		for len(*l1) > 0 {
-			for _, p := range *l1 {
-				for i := -1; i <= 1; i++ {
-					for j := -1; j <= 1; j++ {
-						if (i != 0 || j != 0) && i+j != 0 {
-							pos := Position{X: p.X + i, Y: p.Y + j}
-							vis, ok := visited[pos]
-							if ok && !vis {
-								visited[pos] = true
-								*l2 = append(*l2, pos)
-							}
-						}
-					}
-				}
+// spiderMoves перебирает пути ровно из трёх шагов без повторного посещения клеток.
+func spiderMoves(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+	occupied := board.occupancy(piece)
+	destinations := map[Position]bool{}
+	path := map[Position]bool{piece.Position: true}
+
+	var walk func(current Position, steps int)
+	walk = func(current Position, steps int) {
+		if steps == 3 {
+			if !destinations[current] {
+				destinations[current] = true
+				positions = append(positions, current)
 			}
-			*l1 = *l2
-			*l2 = (*l2)[:0]
+			return
 		}
-		for _, vis := range visited {
-			if !vis {
-				return false
+		for _, pos := range current.neighbours() {
+			if !occupied.occupied(pos) && !path[pos] && canSlide(occupied, current, pos) {
+				path[pos] = true
+				walk(pos, steps+1)
+				delete(path, pos)
 			}
 		}
-		return true
-	} else {
-		return false
 	}
+	walk(piece.Position, 0)
+	return positions
 }
 
-func AvailableToMove(board *Board, piece *Piece) []Position {
+// grasshopperMoves перепрыгивает по прямой через непрерывный ряд фигур.
+func grasshopperMoves(board *Board, piece *Piece) []Position {
 	positions := []Position{}
+	occupied := board.occupancy(piece)
+	for _, d := range directions {
+		pos := piece.Position.Add(d)
+		if !occupied.occupied(pos) {
+			continue
+		}
+		for occupied.occupied(pos) {
+			pos = pos.Add(d)
+		}
+		positions = append(positions, pos)
+	}
+	return positions
+}
 
-	if CanMove(board, piece) {
-		switch piece.Type {
-		case QueenBee:
-			// fmt.Println("QueenBee")
-			for _, p := range board.Pieces {
-				if IsPositionNeignbour(piece.Position, p.Position) {
-					for i := -1; i <= 1; i++ {
-						for j := -1; j <= 1; j++ {
-							if (i != 0 || j != 0) && i+j != 0 {
-								pos := Position{X: piece.Position.X + i, Y: piece.Position.Y + j}
-								if IsPositionNeignbour(pos, p.Position) && CanSqueezeThrough(board, piece.Position, pos, nil, 0) {
-									cellFree := true
-									for _, pp := range board.Pieces {
-										if pp.Position.X == pos.X && pp.Position.Y == pos.Y {
-											cellFree = false
-											break
-										}
-									}
-									if cellFree {
-										positions = append(positions, pos)
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		case SoldierAnt:
-			l1 := &[]Position{}
-			l2 := &[]Position{}
-			set := map[Position]bool{}
-			for _, pp := range board.Pieces {
-				set[pp.Position] = true
+// beetleMoves перемещает жука на одну клетку, в том числе на вершину улья и с неё.
+func beetleMoves(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+	occupied := board.occupancy(piece)
+	for _, pos := range piece.Position.neighbours() {
+		if !occupied.occupied(piece.Position) && !occupied.occupied(pos) {
+			if canSlide(occupied, piece.Position, pos) {
+				positions = append(positions, pos)
 			}
+		} else if canCrawl(occupied, piece.Position, pos) {
+			positions = append(positions, pos)
+		}
+	}
+	return positions
+}
 
-			*l1 = append(*l1, piece.Position)
-
-			for len(*l1) > 0 {
-				setStep := map[Position]bool{}
-				for _, p := range *l1 {
-					for _, pp := range board.Pieces {
-						if pp.Position.X != piece.Position.X || pp.Position.Y != piece.Position.Y {
-							if IsPositionNeignbour(p, pp.Position) {
-								for i := -1; i <= 1; i++ {
-									for j := -1; j <= 1; j++ {
-										if i+j != 0 {
-											pos := Position{X: pp.Position.X + i, Y: pp.Position.Y + j}
-											setStep[pos] = true
-										}
-									}
-								}
-							}
-						}
-					}
-				}
+// mosquitoMoves перенимает ходы верхних фигур соседних клеток. Комар на вершине
+// улья ходит как жук, а соседство только с комарами лишает его хода.
+func mosquitoMoves(board *Board, piece *Piece) []Position {
+	if piece.Level > 0 {
+		return beetleMoves(board, piece)
+	}
 
-				for _, p := range *l1 {
-					for pp := range setStep {
-						if IsPositionNeignbour(p, pp) && CanSqueezeThrough(board, p, pp, &piece.Position, 0) {
-							if _, ok := set[pp]; !ok {
-								positions = append(positions, pp)
-								*l2 = append(*l2, pp)
-								set[pp] = true
-							}
-						}
-					}
-				}
-				*l1 = *l2
-				*l2 = (*l2)[:0]
-			}
-		case Spider:
-			l1 := &[]Position{}
-			l2 := &[]Position{}
-			set := map[Position]bool{}
-			for _, pp := range board.Pieces {
-				set[pp.Position] = true
+	positions := []Position{}
+	copied := map[PieceType]bool{Mosquito: true}
+	added := map[Position]bool{}
+	for _, pos := range piece.Position.neighbours() {
+		top := board.TopPiece(pos)
+		if top == nil || copied[top.Type] {
+			continue
+		}
+		copied[top.Type] = true
+		for _, destination := range movesAs(board, piece, top.Type) {
+			if !added[destination] {
+				added[destination] = true
+				positions = append(positions, destination)
 			}
+		}
+	}
+	return positions
+}
 
-			*l1 = append(*l1, piece.Position)
-
-			k := 0
-			for len(*l1) > 0 && k < 3 {
-
-				println("k=", k)
-
-				setStep := map[Position]bool{}
-				for _, p := range *l1 {
-					for _, pp := range board.Pieces {
-						if pp.Position.X != piece.Position.X || pp.Position.Y != piece.Position.Y {
-							if IsPositionNeignbour(p, pp.Position) {
-								for i := -1; i <= 1; i++ {
-									for j := -1; j <= 1; j++ {
-										if i+j != 0 {
-											pos := Position{X: pp.Position.X + i, Y: pp.Position.Y + j}
-											setStep[pos] = true
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-				for pp := range setStep {
-
-					fmt.Printf("X: %v Y: %v\n", pp.X, pp.Y)
-					for _, p := range *l1 {
-
-						if IsPositionNeignbour(p, pp) && CanSqueezeThrough(board, p, pp, &piece.Position, 0) {
-							if _, ok := set[pp]; !ok {
-								if k == 2 {
-									positions = append(positions, pp)
-								}
-								*l2 = append(*l2, pp)
-								set[pp] = true
-
-							}
-						}
-					}
-				}
-				*l1 = *l2
-				*l2 = (*l2)[:0]
-				k += 1
+// ladybugMoves делает два шага по вершине улья и третьим шагом спускается
+// в свободную клетку.
+func ladybugMoves(board *Board, piece *Piece) []Position {
+	positions := []Position{}
+	occupied := board.occupancy(piece)
+	added := map[Position]bool{}
+	for _, first := range piece.Position.neighbours() {
+		if !occupied.occupied(first) || !canCrawl(occupied, piece.Position, first) {
+			continue
+		}
+		for _, second := range first.neighbours() {
+			if second == piece.Position || !occupied.occupied(second) || !canCrawl(occupied, first, second) {
+				continue
 			}
-		case Grasshopper:
-			set := map[Position]bool{}
-			for _, pp := range board.Pieces {
-				set[pp.Position] = true
+			for _, third := range second.neighbours() {
+				if third == piece.Position || added[third] || occupied.occupied(third) || !canCrawl(occupied, second, third) {
+					continue
+				}
+				added[third] = true
+				positions = append(positions, third)
 			}
+		}
+	}
+	return positions
+}
 
-			for _, p := range board.Pieces {
-				if IsPositionNeignbour(piece.Position, p.Position) {
-					x := p.Position.X - piece.Position.X
-					y := p.Position.Y - piece.Position.Y
-					pos := Position{p.Position.X + x, p.Position.Y + y}
-					_, ok := set[pos]
-					for ok {
-						pos.X += x
-						pos.Y += y
-						_, ok = set[pos]
-					}
-					positions = append(positions, pos)
-				}
+// PillbugThrows возвращает перемещения соседних фигур, которые фигура thrower
+// может выполнить способностью мокрицы: поднять фигуру на себя и опустить
+// в свободную соседнюю клетку. Способностью обладает мокрица и комар рядом
+// с ней, если они не накрыты и не стоят на улье. Фигуру frozen, походившую
+// последней, трогать нельзя, и сама она не может пользоваться способностью.
+func PillbugThrows(board *Board, thrower *Piece, frozen *Piece) map[*Piece][]Position {
+	throws := map[*Piece][]Position{}
+	if thrower == frozen || thrower.Level > 0 || board.TopPiece(thrower.Position) != thrower {
+		return throws
+	}
+	if thrower.Type == Mosquito {
+		nearPillbug := false
+		for _, pos := range thrower.Position.neighbours() {
+			if top := board.TopPiece(pos); top != nil && top.Type == Pillbug {
+				nearPillbug = true
+				break
 			}
-		case Beetle:
-			for _, p := range board.Pieces {
-				if IsPositionNeignbour(piece.Position, p.Position) {
-					for i := -1; i <= 1; i++ {
-						for j := -1; j <= 1; j++ {
-							if i+j != 0 {
-								pos := Position{X: p.Position.X + i, Y: p.Position.Y + j}
-								if IsPositionNeignbour(pos, piece.Position) && CanSqueezeThrough(board, piece.Position, pos, nil, piece.Level) {
-									positions = append(positions, pos)
-								}
-							} else if i == 0 && j == 0 {
-								positions = append(positions, p.Position)
-							}
-						}
-					}
-				}
+		}
+		if !nearPillbug {
+			return throws
+		}
+	} else if thrower.Type != Pillbug {
+		return throws
+	}
+
+	for _, source := range thrower.Position.neighbours() {
+		target := board.TopPiece(source)
+		if target == nil || target == frozen || target.Level > 0 || !CanMove(board, target) {
+			continue
+		}
+		occupied := board.occupancy(target)
+		if !canCrawl(occupied, source, thrower.Position) {
+			continue
+		}
+		for _, destination := range thrower.Position.neighbours() {
+			if destination != source && !occupied.occupied(destination) && canCrawl(occupied, thrower.Position, destination) {
+				throws[target] = append(throws[target], destination)
 			}
 		}
 	}
-	return positions
+	return throws
 }
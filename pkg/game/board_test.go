@@ -0,0 +1,222 @@
+package game
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// randomGames играет games партий со всеми расширениями, делая до 80
+// случайных ходов, и вызывает check в каждой позиции перед очередным ходом.
+// Партия номер seed играется генератором r с тем же зерном; check может
+// брать из него числа для своих случайных выборов.
+func randomGames(t *testing.T, games int, check func(t *testing.T, session *GameSession, r *rand.Rand)) {
+	t.Helper()
+	handInit, err := ExpansionHand("MLP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(0); seed < int64(games); seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			r := rand.New(rand.NewSource(seed))
+			session := NewGameSession(handInit)
+			for i := 0; i < 80 && !session.IsGameOver(); i++ {
+				check(t, session, r)
+				moves := session.LegalMoves()
+				if err := session.ApplyMove(&moves[r.Intn(len(moves))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// midGame возвращает позицию после plies случайных ходов партии со всеми
+// расширениями. Случайность фиксирована, чтобы замеры были сопоставимы.
+func midGame(b *testing.B, plies int) *GameSession {
+	handInit, err := ExpansionHand("MLP")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for seed := int64(1); ; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		session := NewGameSession(handInit)
+		for i := 0; i < plies && !session.IsGameOver(); i++ {
+			// Ходы упорядочиваются, чтобы позиция не зависела от порядка генерации
+			moves := session.LegalMoves()
+			sort.Slice(moves, func(i, j int) bool { return lessMove(moves[i], moves[j]) })
+			if err := session.ApplyMove(&moves[r.Intn(len(moves))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if !session.IsGameOver() {
+			return session
+		}
+	}
+}
+
+func lessMove(lhs, rhs Move) bool {
+	if lhs.Pass || rhs.Pass {
+		return rhs.Pass && !lhs.Pass
+	}
+	if lhs.Piece != rhs.Piece {
+		if lhs.Piece.Color != rhs.Piece.Color {
+			return lhs.Piece.Color < rhs.Piece.Color
+		}
+		if lhs.Piece.Type != rhs.Piece.Type {
+			return lhs.Piece.Type < rhs.Piece.Type
+		}
+		return lhs.Piece.Number < rhs.Piece.Number
+	}
+	if lhs.Position.X != rhs.Position.X {
+		return lhs.Position.X < rhs.Position.X
+	}
+	return lhs.Position.Y < rhs.Position.Y
+}
+
+func benchmarkLegalMoves(b *testing.B, plies int) {
+	session := midGame(b, plies)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		session.LegalMoves()
+	}
+	b.ReportMetric(float64(len(session.GetBoard().Pieces)), "pieces")
+}
+
+func BenchmarkLegalMovesOpening(b *testing.B)  { benchmarkLegalMoves(b, 8) }
+func BenchmarkLegalMovesMidGame(b *testing.B)  { benchmarkLegalMoves(b, 30) }
+func BenchmarkLegalMovesLateGame(b *testing.B) { benchmarkLegalMoves(b, 60) }
+
+// heightsScan — прежний способ узнать высоты стопок: карта строится заново
+// по Pieces для каждой поднятой фигуры. Остаётся базой для сравнения с
+// индексом доски в BenchmarkHeights.
+func heightsScan(board *Board, lifted *Piece) map[Position]int {
+	heights := map[Position]int{}
+	for _, piece := range board.Pieces {
+		if piece != lifted {
+			heights[piece.Position] += 1
+		}
+	}
+	return heights
+}
+
+// BenchmarkHeights сравнивает индекс доски с перебором Pieces на запросах,
+// из которых состоит генерация ходов: высоты клеток вокруг каждой фигуры,
+// поднятой со своего места.
+func BenchmarkHeights(b *testing.B) {
+	for _, phase := range []struct {
+		name  string
+		plies int
+	}{{"Opening", 8}, {"MidGame", 30}, {"LateGame", 60}} {
+		board := midGame(b, phase.plies).GetBoard()
+		b.Run(phase.name+"/index", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, piece := range board.Pieces {
+					occupied := board.occupancy(piece)
+					for _, neighbour := range piece.Position.neighbours() {
+						occupied.height(neighbour)
+					}
+				}
+			}
+		})
+		b.Run(phase.name+"/scan", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, piece := range board.Pieces {
+					heights := heightsScan(board, piece)
+					for _, neighbour := range piece.Position.neighbours() {
+						_ = heights[neighbour]
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkApplyUndo(b *testing.B) {
+	session := midGame(b, 30)
+	moves := session.LegalMoves()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		move := moves[i%len(moves)]
+		if err := session.ApplyMove(&move); err != nil {
+			b.Fatal(err)
+		}
+		if err := session.Undo(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// connectedWithout проверяет связность улья без фигуры piece перебором в ширину.
+func connectedWithout(board *Board, piece *Piece) bool {
+	occupied := map[Position]bool{}
+	for _, p := range board.Pieces {
+		if p != piece {
+			occupied[p.Position] = true
+		}
+	}
+	if len(occupied) == 0 {
+		return false
+	}
+	var start Position
+	for position := range occupied {
+		start = position
+		break
+	}
+	visited := map[Position]bool{start: true}
+	queue := []Position{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, neighbour := range Neighbours(current) {
+			if occupied[neighbour] && !visited[neighbour] {
+				visited[neighbour] = true
+				queue = append(queue, neighbour)
+			}
+		}
+	}
+	return len(visited) == len(occupied)
+}
+
+func TestPinnedPieces(t *testing.T) {
+	randomGames(t, 20, func(t *testing.T, session *GameSession, r *rand.Rand) {
+		board := session.GetBoard()
+		pinned := PinnedPieces(board)
+		for _, piece := range board.Pieces {
+			want := board.TopPiece(piece.Position) != piece || !connectedWithout(board, piece)
+			if pinned[piece] != want {
+				t.Fatalf("ход %d: фигура %+v закреплена %v, ожидалось %v", session.GetTurn(), *piece, pinned[piece], want)
+			}
+			if CanMove(board, piece) == want {
+				t.Fatalf("ход %d: CanMove(%+v) противоречит PinnedPieces", session.GetTurn(), *piece)
+			}
+		}
+	})
+}
+
+func TestPinnedPiecesKnown(t *testing.T) {
+	for _, c := range []struct {
+		state string
+		// pinned — закреплённые фигуры в порядке записи позиции
+		pinned []bool
+	}{
+		// Муравей между королевами держит улей, королевы на краях свободны
+		{"QAq - w 3", []bool{false, true, false}},
+		// Белая королева накрыта жуком, а сам жук может уйти
+		{"(Qb)Aq - w 3", []bool{true, false, true, false}},
+		// В кольце без середины любую фигуру можно убрать
+		{"AG/S1B/1ag - w 4", []bool{false, false, false, false, false, false}},
+	} {
+		state, err := ParseState(c.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned := PinnedPieces(state.Board)
+		for i, piece := range state.Board.Pieces {
+			if pinned[piece] != c.pinned[i] {
+				t.Errorf("%s: фигура %+v закреплена %v, ожидалось %v", c.state, *piece, pinned[piece], c.pinned[i])
+			}
+		}
+	}
+}
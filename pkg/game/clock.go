@@ -0,0 +1,101 @@
+package game
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrBadTimeControl = errors.New("некорректный контроль времени")
+
+// TimeControl — контроль времени партии: основной запас Base, к которому
+// после каждого хода добавляется Increment, или фиксированное время PerMove
+// на каждый ход, которое не накапливается. Нулевое значение отключает часы.
+type TimeControl struct {
+	Base      time.Duration
+	Increment time.Duration
+	PerMove   time.Duration
+}
+
+// Enabled сообщает, идут ли в партии часы.
+func (tc TimeControl) Enabled() bool {
+	return tc.Base > 0 || tc.PerMove > 0
+}
+
+func (tc TimeControl) Validate() error {
+	switch {
+	case tc.Base < 0 || tc.Increment < 0 || tc.PerMove < 0:
+		return ErrBadTimeControl
+	case tc.PerMove > 0 && (tc.Base > 0 || tc.Increment > 0):
+		return errors.New("время на ход задаётся без основного запаса и добавления")
+	case tc.Increment > 0 && tc.Base == 0:
+		return errors.New("добавление времени задаётся вместе с основным запасом")
+	}
+	return nil
+}
+
+// Clock — шахматные часы партии. Идут часы только одного игрока: Start
+// запускает их, Stop останавливает после хода и начисляет добавление.
+// Моменты времени передаются явно, чтобы часы не зависели от таймеров.
+type Clock struct {
+	control   TimeControl
+	remaining [2]time.Duration
+	running   bool
+	color     PieceColor
+	started   time.Time
+}
+
+func NewClock(control TimeControl) *Clock {
+	initial := control.Base
+	if control.PerMove > 0 {
+		initial = control.PerMove
+	}
+	return &Clock{
+		control:   control,
+		remaining: [2]time.Duration{initial, initial},
+	}
+}
+
+// Running сообщает, идут ли часы.
+func (c *Clock) Running() bool {
+	return c.running
+}
+
+// Start запускает часы игрока color в момент now.
+func (c *Clock) Start(color PieceColor, now time.Time) {
+	c.running = true
+	c.color = color
+	c.started = now
+}
+
+// Stop останавливает часы в момент now, когда игрок сделал ход.
+// Флажок не должен упасть раньше: это проверяется по Remaining.
+func (c *Clock) Stop(now time.Time) {
+	if !c.running {
+		return
+	}
+	remaining := c.Remaining(c.color, now)
+	if c.control.PerMove > 0 {
+		remaining = c.control.PerMove
+	} else if remaining > 0 {
+		remaining += c.control.Increment
+	}
+	c.remaining[c.color] = remaining
+	c.running = false
+}
+
+// Remaining возвращает время игрока color, оставшееся в момент now.
+func (c *Clock) Remaining(color PieceColor, now time.Time) time.Duration {
+	remaining := c.remaining[color]
+	if c.running && c.color == color {
+		remaining -= now.Sub(c.started)
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Deadline возвращает момент, когда упадёт флажок идущих часов.
+func (c *Clock) Deadline() time.Time {
+	return c.started.Add(c.remaining[c.color])
+}
@@ -0,0 +1,86 @@
+package game
+
+import (
+	"testing"
+	"time"
+)
+
+var clockStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// at возвращает момент через d после clockStart.
+func at(d time.Duration) time.Time {
+	return clockStart.Add(d)
+}
+
+func TestClockIncrement(t *testing.T) {
+	clock := NewClock(TimeControl{Base: time.Minute, Increment: 2 * time.Second})
+	clock.Start(White, at(0))
+	if !clock.Running() || clock.Deadline() != at(time.Minute) {
+		t.Fatalf("флажок упадёт в %v", clock.Deadline())
+	}
+	if remaining := clock.Remaining(White, at(15*time.Second)); remaining != 45*time.Second {
+		t.Fatalf("через 15 с осталось %v", remaining)
+	}
+	clock.Stop(at(10 * time.Second))
+	if clock.Running() {
+		t.Fatal("часы идут после хода")
+	}
+
+	// Добавление начисляется ходившему, часы соперника не тронуты
+	if remaining := clock.Remaining(White, at(time.Hour)); remaining != 52*time.Second {
+		t.Fatalf("после хода у белых %v", remaining)
+	}
+	clock.Start(Black, at(10*time.Second))
+	if remaining := clock.Remaining(Black, at(15*time.Second)); remaining != 55*time.Second {
+		t.Fatalf("у чёрных %v", remaining)
+	}
+	if remaining := clock.Remaining(White, at(15*time.Second)); remaining != 52*time.Second {
+		t.Fatalf("часы белых идут в ход чёрных: %v", remaining)
+	}
+}
+
+func TestClockPerMove(t *testing.T) {
+	clock := NewClock(TimeControl{PerMove: 10 * time.Second})
+	for i, spent := range []time.Duration{3 * time.Second, 9 * time.Second, 0} {
+		clock.Start(White, at(0))
+		clock.Stop(at(spent))
+		// Неиспользованное время не накапливается
+		if remaining := clock.Remaining(White, at(spent)); remaining != 10*time.Second {
+			t.Fatalf("ход %d: осталось %v", i, remaining)
+		}
+	}
+}
+
+func TestClockFlag(t *testing.T) {
+	clock := NewClock(TimeControl{Base: 5 * time.Second, Increment: 2 * time.Second})
+	clock.Start(Black, at(0))
+	if remaining := clock.Remaining(Black, at(time.Hour)); remaining != 0 {
+		t.Fatalf("после падения флажка осталось %v", remaining)
+	}
+	// Ход после падения флажка не возвращает время добавлением
+	clock.Stop(at(6 * time.Second))
+	if remaining := clock.Remaining(Black, at(6*time.Second)); remaining != 0 {
+		t.Fatalf("после позднего хода осталось %v", remaining)
+	}
+	if remaining := clock.Remaining(White, at(6*time.Second)); remaining != 5*time.Second {
+		t.Fatalf("у белых %v", remaining)
+	}
+}
+
+func TestTimeControlValidate(t *testing.T) {
+	for _, c := range []struct {
+		control TimeControl
+		valid   bool
+	}{
+		{TimeControl{}, true},
+		{TimeControl{Base: time.Minute, Increment: time.Second}, true},
+		{TimeControl{PerMove: time.Second}, true},
+		{TimeControl{Base: -time.Second}, false},
+		{TimeControl{Increment: time.Second}, false},
+		{TimeControl{Base: time.Minute, PerMove: time.Second}, false},
+	} {
+		if err := c.control.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: %v", c.control, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package game
+
+import "sort"
+
+// grid — индекс доски по клеткам: стопки фигур снизу вверх и фигуры по
+// идентификаторам. Индекс строится по Board.Pieces при первом обращении и
+// дальше поддерживается методами add, remove и moveTo, через которые
+// GameSession применяет и отменяет ходы. Если Pieces заменили или изменили
+// его длину в обход этих методов, индекс строится заново.
+type grid struct {
+	stacks map[cell][]*Piece
+	pieces map[PieceID]*Piece
+	// board — срез Board.Pieces, по которому построен индекс
+	board []*Piece
+	// hive — граф соседства занятых клеток, строится по требованию
+	// и сбрасывается при любом изменении доски.
+	hive *hive
+}
+
+// cell — упакованные координаты клетки. Ключ uint64 хэшируется заметно
+// быстрее структуры из двух int, а обращений к индексу при генерации ходов
+// очень много.
+type cell uint64
+
+func cellOf(position Position) cell {
+	return cell(uint32(int32(position.X)))<<32 | cell(uint32(int32(position.Y)))
+}
+
+// hive хранит занятые клетки с номерами и таблицу соседей: neighbours[i][d] —
+// номер занятой клетки в направлении d от клетки i или -1. articulation[i]
+// отмечает клетки, без которых улей распадается на части.
+type hive struct {
+	cells        []Position
+	index        map[cell]int
+	neighbours   [][6]int
+	articulation []bool
+}
+
+func (b *Board) grid() *grid {
+	if b.index != nil && samePieces(b.index.board, b.Pieces) {
+		return b.index
+	}
+
+	index := &grid{
+		board:  b.Pieces,
+		stacks: make(map[cell][]*Piece, len(b.Pieces)),
+		pieces: make(map[PieceID]*Piece, len(b.Pieces)),
+	}
+	for _, piece := range b.Pieces {
+		key := cellOf(piece.Position)
+		index.stacks[key] = append(index.stacks[key], piece)
+		index.pieces[piece.ID()] = piece
+	}
+	for _, stack := range index.stacks {
+		if len(stack) > 1 {
+			sort.Slice(stack, func(i, j int) bool { return stack[i].Level < stack[j].Level })
+		}
+	}
+	b.index = index
+	return index
+}
+
+// samePieces сообщает, указывают ли срезы на одни и те же элементы.
+func samePieces(a, b []*Piece) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+func (g *grid) stack(position Position) []*Piece {
+	return g.stacks[cellOf(position)]
+}
+
+func (g *grid) height(position Position) int {
+	return len(g.stacks[cellOf(position)])
+}
+
+// top возвращает верхнюю фигуру стопки или nil.
+func (g *grid) top(position Position) *Piece {
+	stack := g.stacks[cellOf(position)]
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[len(stack)-1]
+}
+
+func (g *grid) push(piece *Piece) {
+	key := cellOf(piece.Position)
+	piece.Level = len(g.stacks[key])
+	g.stacks[key] = append(g.stacks[key], piece)
+	g.hive = nil
+}
+
+func (g *grid) pop(position Position) {
+	key := cellOf(position)
+	stack := g.stacks[key]
+	if len(stack) == 1 {
+		delete(g.stacks, key)
+	} else {
+		g.stacks[key] = stack[:len(stack)-1]
+	}
+	g.hive = nil
+}
+
+// add кладёт фигуру на вершину стопки в клетке piece.Position.
+func (b *Board) add(piece *Piece) {
+	g := b.grid()
+	b.Pieces = append(b.Pieces, piece)
+	g.board = b.Pieces
+	g.push(piece)
+	g.pieces[piece.ID()] = piece
+}
+
+// remove снимает с доски фигуру, лежащую на вершине своей стопки.
+// Порядок остальных фигур в Pieces сохраняется.
+func (b *Board) remove(piece *Piece) {
+	g := b.grid()
+	for i, p := range b.Pieces {
+		if p == piece {
+			b.Pieces = append(b.Pieces[:i], b.Pieces[i+1:]...)
+			break
+		}
+	}
+	g.board = b.Pieces
+	g.pop(piece.Position)
+	delete(g.pieces, piece.ID())
+}
+
+// moveTo переносит фигуру с вершины её стопки на вершину стопки в клетке position.
+func (b *Board) moveTo(piece *Piece, position Position) {
+	g := b.grid()
+	g.pop(piece.Position)
+	piece.Position = position
+	g.push(piece)
+}
+
+// graph возвращает граф соседства занятых клеток.
+func (g *grid) graph() *hive {
+	if g.hive != nil {
+		return g.hive
+	}
+
+	h := &hive{
+		cells: make([]Position, 0, len(g.stacks)),
+		index: make(map[cell]int, len(g.stacks)),
+	}
+	for _, stack := range g.stacks {
+		position := stack[0].Position
+		h.index[cellOf(position)] = len(h.cells)
+		h.cells = append(h.cells, position)
+	}
+	h.neighbours = make([][6]int, len(h.cells))
+	for i, position := range h.cells {
+		for d, neighbour := range position.neighbours() {
+			if j, ok := h.index[cellOf(neighbour)]; ok {
+				h.neighbours[i][d] = j
+			} else {
+				h.neighbours[i][d] = -1
+			}
+		}
+	}
+	h.findArticulation()
+	g.hive = h
+	return h
+}
+
+// findArticulation отмечает точки сочленения графа улья алгоритмом Хопкрофта —
+// Тарьяна за один обход в глубину: клетка i, не являющаяся корнем обхода,
+// разрезает граф, если из поддерева какого-либо её потомка нельзя подняться
+// выше i по обратному ребру. Корень разрезает граф, если у него больше
+// одного потомка в дереве обхода.
+func (h *hive) findArticulation() {
+	h.articulation = make([]bool, len(h.cells))
+	if len(h.cells) == 0 {
+		return
+	}
+	order := make([]int, len(h.cells))
+	low := make([]int, len(h.cells))
+	visited := 0
+
+	var visit func(i, parent int)
+	visit = func(i, parent int) {
+		visited += 1
+		order[i], low[i] = visited, visited
+		children := 0
+		for _, j := range h.neighbours[i] {
+			if j < 0 || j == parent {
+				continue
+			}
+			if order[j] != 0 {
+				if order[j] < low[i] {
+					low[i] = order[j]
+				}
+				continue
+			}
+			children += 1
+			visit(j, i)
+			if low[j] < low[i] {
+				low[i] = low[j]
+			}
+			if parent >= 0 && low[j] >= order[i] {
+				h.articulation[i] = true
+			}
+		}
+		if parent < 0 && children > 1 {
+			h.articulation[i] = true
+		}
+	}
+	visit(0, -1)
+}
+
+// occupancy возвращает высоты стопок доски, как если бы фигура lifted
+// была поднята со своей клетки. Поднимать можно только верхнюю фигуру стопки.
+func (b *Board) occupancy(lifted *Piece) occupancy {
+	return occupancy{grid: b.grid(), lifted: lifted}
+}
+
+type occupancy struct {
+	grid   *grid
+	lifted *Piece
+}
+
+func (o occupancy) height(position Position) int {
+	height := o.grid.height(position)
+	if o.lifted != nil && o.lifted.Position == position {
+		height -= 1
+	}
+	return height
+}
+
+func (o occupancy) occupied(position Position) bool {
+	return o.height(position) > 0
+}
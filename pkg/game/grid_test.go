@@ -0,0 +1,123 @@
+package game
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// checkCell проверяет высоту стопки и верхнюю фигуру клетки по индексу доски.
+func checkCell(t *testing.T, board *Board, position Position, height int, top *PieceID) {
+	t.Helper()
+	if h := board.Height(position); h != height {
+		t.Fatalf("высота %v — %d, ожидалась %d", position, h, height)
+	}
+	piece := board.TopPiece(position)
+	if top == nil && piece != nil || top != nil && (piece == nil || piece.ID() != *top || piece.Position != position) {
+		t.Fatalf("наверху %v лежит %+v, ожидалась %+v", position, piece, top)
+	}
+}
+
+func TestGridFollowsMoves(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	for _, move := range opening {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	board := session.GetBoard()
+	ant := PieceID{Color: White, Type: SoldierAnt, Number: 1}
+	queen := PieceID{Color: Black, Type: QueenBee, Number: 1}
+	from, to := Position{X: -1, Y: 0}, Position{X: 1, Y: 1}
+	checkCell(t, board, from, 1, &ant)
+	checkCell(t, board, to, 0, nil)
+
+	// Перемещение не меняет число фигур, но индекс обновляет обе клетки
+	move := Move{Piece: ant, Position: &to}
+	if err := session.ApplyMove(&move); err != nil {
+		t.Fatal(err)
+	}
+	checkCell(t, board, from, 0, nil)
+	checkCell(t, board, to, 1, &ant)
+	if board.Piece(ant).Position != to {
+		t.Fatalf("муравей найден в %v", board.Piece(ant).Position)
+	}
+
+	// Жук поднимается на муравья, затем на королеву и спускается обратно при отмене
+	beetle := PieceID{Color: Black, Type: Beetle, Number: 1}
+	blackAnt := PieceID{Color: Black, Type: SoldierAnt, Number: 1}
+	for _, move := range []Move{
+		place(Black, Beetle, 1, 3, 0),
+		place(White, Spider, 1, -1, 0),
+		place(Black, Beetle, 1, 2, 0),
+		place(White, Spider, 2, -2, 0),
+		place(Black, Beetle, 1, 1, 0),
+	} {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatalf("ход %+v: %v", move, err)
+		}
+	}
+	checkCell(t, board, Position{X: 1, Y: 0}, 2, &beetle)
+	checkCell(t, board, Position{X: 2, Y: 0}, 1, &blackAnt)
+
+	if err := session.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	checkCell(t, board, Position{X: 1, Y: 0}, 1, &queen)
+	checkCell(t, board, Position{X: 2, Y: 0}, 2, &beetle)
+	for i := 0; i < 5; i++ {
+		if err := session.Undo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCell(t, board, from, 1, &ant)
+	checkCell(t, board, to, 0, nil)
+	checkCell(t, board, Position{X: 3, Y: 0}, 0, nil)
+	if board.Piece(beetle) != nil {
+		t.Fatal("отменённый жук остался в индексе")
+	}
+}
+
+func TestGridRebuild(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	for _, move := range opening {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	board := session.GetBoard()
+	ant := PieceID{Color: White, Type: SoldierAnt, Number: 1}
+	from, to := Position{X: -1, Y: 0}, Position{X: 1, Y: 1}
+	checkCell(t, board, from, 1, &ant)
+	data, err := json.Marshal(board)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Замена среза той же длины: муравей перенесён в копии фигур
+	moved := make([]*Piece, len(board.Pieces))
+	for i, piece := range board.Pieces {
+		copied := *piece
+		if copied.ID() == ant {
+			copied.Position = to
+		}
+		moved[i] = &copied
+	}
+	board.Pieces = moved
+	checkCell(t, board, from, 0, nil)
+	checkCell(t, board, to, 1, &ant)
+
+	// Декодирование поверх доски с тем же числом фигур
+	if err = json.Unmarshal(data, board); err != nil {
+		t.Fatal(err)
+	}
+	checkCell(t, board, from, 1, &ant)
+	checkCell(t, board, to, 0, nil)
+
+	// Фигура, дописанная в Pieces напрямую
+	beetle := PieceID{Color: White, Type: Beetle, Number: 1}
+	board.Pieces = append(board.Pieces, &Piece{Color: White, Type: Beetle, Number: 1, Position: to})
+	checkCell(t, board, to, 1, &beetle)
+}
@@ -0,0 +1,28 @@
+package game
+
+// Perft возвращает число листьев дерева допустимых ходов глубины depth из
+// текущей позиции сессии. Пропуск хода считается ходом, а законченная до
+// нужной глубины партия листьев не даёт. Сессия после подсчёта остаётся
+// в исходном состоянии.
+func (gs *GameSession) Perft(depth int) int {
+	if depth == 0 {
+		return 1
+	}
+	moves := gs.LegalMoves()
+	if depth == 1 {
+		return len(moves)
+	}
+
+	// Ходы из LegalMoves уже проверены, поэтому применяются без повторной проверки
+	redo := gs.redo
+	nodes := 0
+	for i := range moves {
+		gs.apply(&moves[i], gs.board.Piece(moves[i].Piece))
+		nodes += gs.Perft(depth - 1)
+		if err := gs.Undo(); err != nil {
+			panic(err)
+		}
+	}
+	gs.redo = redo
+	return nodes
+}
@@ -0,0 +1,47 @@
+package game_test
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"hive/pkg/notation"
+)
+
+func TestPerft(t *testing.T) {
+	f, err := os.Open("testdata/perft.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		gameString, expected, ok := strings.Cut(text, " = ")
+		if !ok {
+			t.Fatalf("строка %d: нет разделителя \" = \"", line)
+		}
+		session, _, err := notation.ParseGameString(gameString)
+		if err != nil {
+			t.Fatalf("строка %d: %v", line, err)
+		}
+		for i, field := range strings.Fields(expected) {
+			want, err := strconv.Atoi(field)
+			if err != nil {
+				t.Fatalf("строка %d: %v", line, err)
+			}
+			if got := session.Perft(i + 1); got != want {
+				t.Errorf("строка %d: perft(%d) = %d, ожидалось %d\n%s", line, i+1, got, want, gameString)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrQueenFirst        = errors.New("по турнирным правилам королеву улья нельзя выставлять первым ходом")
+	ErrOpeningRestricted = errors.New("первым ходом насекомых этого типа выставлять нельзя")
+)
+
+// DefaultQueenDeadline — ход игрока, не позднее которого по стандартным
+// правилам выставляется королева улья.
+const DefaultQueenDeadline = 4
+
+// Rules описывает вариант правил партии. Нулевое значение соответствует
+// базовой игре по стандартным правилам.
+type Rules struct {
+	// Expansions — буквы расширений в том виде, как их принимает ExpansionHand, например "MLP".
+	Expansions string
+	// Tournament запрещает выставлять королеву улья первым ходом.
+	Tournament bool
+	// QueenDeadline — номер хода игрока, не позднее которого нужно выставить
+	// королеву улья. Ноль означает DefaultQueenDeadline.
+	QueenDeadline int
+	// Openings — типы насекомых, которые разрешено выставить первым ходом.
+	// Пустой список ограничений не накладывает.
+	Openings []PieceType
+}
+
+// Validate проверяет, что правила непротиворечивы и у каждого игрока есть
+// допустимый первый ход.
+func (r Rules) Validate() error {
+	handInit, err := ExpansionHand(r.Expansions)
+	if err != nil {
+		return err
+	}
+	if r.QueenDeadline < 0 {
+		return fmt.Errorf("некорректный срок выставления королевы улья: %d", r.QueenDeadline)
+	}
+
+	hand := handInit(White)
+	for _, pieceType := range r.Openings {
+		if _, ok := hand.Pieces[pieceType]; !ok {
+			return fmt.Errorf("в партии нет насекомых типа %d, разрешённых первым ходом", pieceType)
+		}
+	}
+	for pieceType := range hand.Pieces {
+		if r.QueenRequired(0, hand) && pieceType != QueenBee {
+			continue
+		}
+		if r.openingError(pieceType) == nil {
+			return nil
+		}
+	}
+	return errors.New("правила не оставляют допустимого первого хода")
+}
+
+// HandInit возвращает функцию, создающую начальные руки игроков.
+func (r Rules) HandInit() (func(PieceColor) *Hand, error) {
+	return ExpansionHand(r.Expansions)
+}
+
+// Deadline возвращает номер хода игрока, не позднее которого нужно выставить королеву улья.
+func (r Rules) Deadline() int {
+	if r.QueenDeadline == 0 {
+		return DefaultQueenDeadline
+	}
+	return r.QueenDeadline
+}
+
+// QueenRequired сообщает, что на полуходе turn игрок с рукой hand обязан
+// выставить королеву улья.
+func (r Rules) QueenRequired(turn int, hand *Hand) bool {
+	return turn/2+1 >= r.Deadline() && hand.Pieces[QueenBee] > 0
+}
+
+// openingError проверяет, можно ли выставить насекомое типа pieceType первым ходом.
+func (r Rules) openingError(pieceType PieceType) error {
+	if r.Tournament && pieceType == QueenBee {
+		return ErrQueenFirst
+	}
+	if len(r.Openings) == 0 {
+		return nil
+	}
+	for _, allowed := range r.Openings {
+		if allowed == pieceType {
+			return nil
+		}
+	}
+	return ErrOpeningRestricted
+}
+
+// expansionsOf восстанавливает буквы расширений по начальной руке.
+func expansionsOf(hand *Hand) string {
+	expansions := ""
+	for _, expansion := range expansionPieces {
+		if _, ok := hand.Pieces[expansion.pieceType]; ok {
+			expansions += string(expansion.letter)
+		}
+	}
+	return expansions
+}
@@ -1,18 +1,114 @@
 package game
 
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrGameOver           = errors.New("игра уже окончена")
+	ErrInvalidMove        = errors.New("ход не содержит фигуры или клетки назначения")
+	ErrNotYourTurn        = errors.New("сейчас ход соперника")
+	ErrNotYourPiece       = errors.New("нельзя ходить фигурой соперника")
+	ErrPieceNotFound      = errors.New("на доске нет такой фигуры")
+	ErrPieceCovered       = errors.New("фигура накрыта другой фигурой и не может двигаться")
+	ErrPieceNotInHand     = errors.New("в руке не осталось насекомых этого типа")
+	ErrQueenNotPlaced     = errors.New("перемещать фигуры можно только после размещения королевы улья")
+	ErrQueenRequired      = errors.New("королева улья должна быть выставлена в срок, установленный правилами")
+	ErrPiecePinned        = errors.New("перемещение фигуры разрывает улей")
+	ErrPieceFrozen        = errors.New("фигуру, перемещённую соперником, нельзя двигать в этот ход")
+	ErrIllegalDestination = errors.New("недопустимая клетка назначения")
+	ErrPassNotAllowed     = errors.New("пропустить ход можно только при отсутствии допустимых ходов")
+	ErrNothingToUndo      = errors.New("нет ходов для отмены")
+	ErrNothingToRedo      = errors.New("нет отменённых ходов для повтора")
+)
+
 type Hand struct {
 	Pieces map[PieceType]int
 	Color  PieceColor
 }
 
+type GameResult int
+
+const (
+	InProgress GameResult = iota
+	WhiteWon
+	BlackWon
+	Draw
+)
+
+var resultNames = map[GameResult]string{
+	InProgress: "InProgress",
+	WhiteWon:   "WhiteWins",
+	BlackWon:   "BlackWins",
+	Draw:       "Draw",
+}
+
+// String возвращает название результата в том виде, в каком его записывает
+// Universal Hive Protocol, например "WhiteWins".
+func (r GameResult) String() string {
+	if name, ok := resultNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("GameResult(%d)", int(r))
+}
+
+func (r GameResult) MarshalText() ([]byte, error) {
+	if _, ok := resultNames[r]; !ok {
+		return nil, fmt.Errorf("неизвестный результат партии %d", int(r))
+	}
+	return []byte(r.String()), nil
+}
+
+func (r *GameResult) UnmarshalText(b []byte) error {
+	for result, name := range resultNames {
+		if name == string(b) {
+			*r = result
+			return nil
+		}
+	}
+	return fmt.Errorf("неизвестный результат партии %q", b)
+}
+
+// Won сообщает, победил ли игрок цвета color.
+func (r GameResult) Won(color PieceColor) bool {
+	return r == WhiteWon && color == White || r == BlackWon && color == Black
+}
+
 type GameSession struct {
+	rules    Rules
 	board    *Board
 	white    *Hand
 	black    *Hand
 	turn     int
 	gameOver bool
+	result   GameResult
+	// adjudicated — результат партии определён не позицией на доске,
+	// а поражением одного из игроков или соглашением на ничью.
+	adjudicated bool
+	// lastMoved — фигура, размещённая или перемещённая последним ходом.
+	// До следующего хода её нельзя трогать способностью мокрицы.
+	lastMoved *Piece
+	// history — сыгранные ходы по порядку, redo — отменённые ходы,
+	// последний отменённый в конце.
+	history []undoEntry
+	redo    []Move
+	// hash — хэш Zobrist текущей позиции с учётом очереди хода,
+	// positions — хэши всех позиций партии для поиска повторений.
+	hash      uint64
+	positions []uint64
+}
+
+// undoEntry хранит ход и сведения, нужные для его отмены.
+type undoEntry struct {
+	move      Move
+	placed    bool
+	from      Position
+	lastMoved *PieceID
 }
 
+// NewGameSession начинает партию по стандартным правилам с начальными
+// руками, созданными handInit.
 func NewGameSession(handInit func(PieceColor) *Hand) *GameSession {
 	gs := &GameSession{
 		board:    &Board{},
@@ -21,6 +117,44 @@ func NewGameSession(handInit func(PieceColor) *Hand) *GameSession {
 		turn:     0,
 		gameOver: false,
 	}
+	gs.rules = Rules{Expansions: expansionsOf(gs.white)}
+	gs.positions = []uint64{gs.hash}
+
+	return gs
+}
+
+// NewGameSessionWithRules начинает партию по варианту правил rules.
+func NewGameSessionWithRules(rules Rules) (*GameSession, error) {
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	handInit, err := rules.HandInit()
+	if err != nil {
+		return nil, err
+	}
+	gs := NewGameSession(handInit)
+	gs.rules = rules
+	return gs, nil
+}
+
+// NewGameSessionFromState восстанавливает сессию по известному состоянию
+// партии, например по полученному от сервера StatusUpdate.
+func NewGameSessionFromState(rules Rules, board *Board, white, black *Hand, turn int) *GameSession {
+	gs := &GameSession{
+		rules: rules,
+		board: board,
+		white: white,
+		black: black,
+		turn:  turn,
+	}
+	// Доску могли собрать или изменить в обход индекса
+	board.index = nil
+	gs.hash = board.Hash()
+	if !gs.WhiteToMove() {
+		gs.hash ^= blackToMoveKey
+	}
+	gs.positions = []uint64{gs.hash}
+	gs.updateResult()
 
 	return gs
 }
@@ -37,10 +171,87 @@ func StandardHand(color PieceColor) *Hand {
 	}
 }
 
+// ExpansionHand возвращает начальную руку базовой игры, дополненную насекомыми
+// расширений: M — комар, L — божья коровка, P — мокрица. Например, "MLP".
+func ExpansionHand(expansions string) (func(PieceColor) *Hand, error) {
+	extra := map[PieceType]int{}
+	for _, letter := range expansions {
+		pieceType, ok := expansionPiece(letter)
+		if !ok {
+			return nil, fmt.Errorf("неизвестное расширение %q", letter)
+		}
+		if extra[pieceType] > 0 {
+			return nil, fmt.Errorf("расширение %q указано дважды", letter)
+		}
+		extra[pieceType] = 1
+	}
+
+	return func(color PieceColor) *Hand {
+		hand := StandardHand(color)
+		for pieceType, count := range extra {
+			hand.Pieces[pieceType] = count
+		}
+		return hand
+	}, nil
+}
+
+var expansionPieces = []struct {
+	letter    rune
+	pieceType PieceType
+}{{'M', Mosquito}, {'L', Ladybug}, {'P', Pillbug}}
+
+func expansionPiece(letter rune) (PieceType, bool) {
+	for _, expansion := range expansionPieces {
+		if expansion.letter == letter {
+			return expansion.pieceType, true
+		}
+	}
+	return 0, false
+}
+
+// Clone возвращает независимую копию сессии. Порядок фигур на доске сохраняется.
+func (gs *GameSession) Clone() *GameSession {
+	clone := &GameSession{
+		rules:       gs.rules,
+		board:       &Board{Pieces: make([]*Piece, 0, len(gs.board.Pieces))},
+		white:       gs.white.clone(),
+		black:       gs.black.clone(),
+		turn:        gs.turn,
+		gameOver:    gs.gameOver,
+		result:      gs.result,
+		adjudicated: gs.adjudicated,
+		history:     append([]undoEntry{}, gs.history...),
+		redo:        append([]Move{}, gs.redo...),
+		hash:        gs.hash,
+		positions:   append([]uint64{}, gs.positions...),
+	}
+	for _, piece := range gs.board.Pieces {
+		copied := *piece
+		clone.board.Pieces = append(clone.board.Pieces, &copied)
+		if piece == gs.lastMoved {
+			clone.lastMoved = &copied
+		}
+	}
+	return clone
+}
+
+func (h *Hand) clone() *Hand {
+	pieces := make(map[PieceType]int, len(h.Pieces))
+	for pieceType, count := range h.Pieces {
+		pieces[pieceType] = count
+	}
+	return &Hand{Pieces: pieces, Color: h.Color}
+}
+
 func (gs *GameSession) WhiteToMove() bool {
 	return gs.turn%2 == 0
 }
 
+// Rules возвращает вариант правил партии.
+func (gs *GameSession) Rules() Rules {
+	return gs.rules
+}
+
 func (gs *GameSession) IsGameOver() bool {
 	return gs.gameOver
 }
@@ -57,10 +268,410 @@ func (gs *GameSession) GetBlackHand() *Hand {
 	return gs.black
 }
 
+func (gs *GameSession) ColorToMove() PieceColor {
+	if gs.WhiteToMove() {
+		return White
+	}
+	return Black
+}
+
+func (gs *GameSession) GetHand(color PieceColor) *Hand {
+	if color == White {
+		return gs.white
+	}
+	return gs.black
+}
+
 func (gs *GameSession) NextTurn() {
 	gs.turn += 1
+	gs.hash ^= blackToMoveKey
+	gs.positions = append(gs.positions, gs.hash)
+	gs.updateResult()
+}
+
+// Hash возвращает хэш Zobrist текущей позиции, учитывающий расположение
+// фигур, порядок фигур в стопках и очередь хода. Хэш обновляется при каждом
+// ходе и подходит для таблиц транспозиций движков.
+func (gs *GameSession) Hash() uint64 {
+	return gs.hash
+}
+
+// Repetitions возвращает, сколько раз текущая позиция встречалась в партии,
+// включая текущий раз.
+func (gs *GameSession) Repetitions() int {
+	count := 0
+	for _, hash := range gs.positions {
+		if hash == gs.hash {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (gs *GameSession) Result() GameResult {
+	return gs.result
+}
+
+// updateResult проверяет, окружена ли королева улья каждого из игроков.
+// Если окружены обе королевы одновременно или позиция повторилась в третий
+// раз, объявляется ничья.
+func (gs *GameSession) updateResult() {
+	if gs.adjudicated {
+		return
+	}
+	whiteLost := gs.QueenSurrounded(White)
+	blackLost := gs.QueenSurrounded(Black)
+
+	switch {
+	case whiteLost && blackLost || gs.Repetitions() >= 3:
+		gs.result = Draw
+	case whiteLost:
+		gs.result = BlackWon
+	case blackLost:
+		gs.result = WhiteWon
+	default:
+		gs.result = InProgress
+	}
+	gs.gameOver = gs.result != InProgress
+}
+
+// Forfeit завершает партию поражением игрока color независимо от позиции,
+// например за нарушение правил протокола или сдачу.
+func (gs *GameSession) Forfeit(color PieceColor) {
+	gs.adjudicated = true
+	gs.gameOver = true
+	gs.result = WhiteWon
+	if color == White {
+		gs.result = BlackWon
+	}
+}
+
+// AgreeDraw завершает партию ничьей по соглашению игроков.
+func (gs *GameSession) AgreeDraw() {
+	gs.adjudicated = true
+	gs.gameOver = true
+	gs.result = Draw
+}
+
+// QueenSurrounded сообщает, окружена ли королева улья игрока color.
+func (gs *GameSession) QueenSurrounded(color PieceColor) bool {
+	queen := gs.board.Piece(PieceID{Color: color, Type: QueenBee, Number: 1})
+	return queen != nil && IsSurrounded(gs.board, queen.Position)
 }
 
 func (gs *GameSession) GetTurn() int {
 	return gs.turn
 }
+
+// ValidateMove проверяет ход стороны, чья сейчас очередь, не изменяя сессию.
+// Фигура хода ищется на доске сессии по идентификатору; для размещения новой
+// фигуры идентификатор должен содержать следующий порядковый номер NextNumber.
+func (gs *GameSession) ValidateMove(move *Move) error {
+	_, err := gs.resolveMove(move)
+	return err
+}
+
+// ApplyMove проверяет ход, применяет его к доске и передаёт очередь сопернику.
+// Отменённые ранее ходы после этого повторить уже нельзя.
+func (gs *GameSession) ApplyMove(move *Move) error {
+	if err := gs.play(move); err != nil {
+		return err
+	}
+	gs.redo = nil
+	return nil
+}
+
+// Undo отменяет последний сыгранный ход, восстанавливая доску, руки,
+// высоты стопок и очередь хода.
+func (gs *GameSession) Undo() error {
+	if len(gs.history) == 0 {
+		return ErrNothingToUndo
+	}
+	entry := gs.history[len(gs.history)-1]
+	gs.history = gs.history[:len(gs.history)-1]
+
+	if !entry.move.Pass {
+		piece := gs.board.Piece(entry.move.Piece)
+		gs.hash ^= zobristKey(piece)
+		if entry.placed {
+			gs.board.remove(piece)
+			gs.GetHand(piece.Color).Pieces[piece.Type] += 1
+		} else {
+			gs.board.moveTo(piece, entry.from)
+			gs.hash ^= zobristKey(piece)
+		}
+	}
+
+	gs.lastMoved = nil
+	if entry.lastMoved != nil {
+		gs.lastMoved = gs.board.Piece(*entry.lastMoved)
+	}
+	gs.turn -= 1
+	gs.hash ^= blackToMoveKey
+	gs.positions = gs.positions[:len(gs.positions)-1]
+	gs.updateResult()
+	gs.redo = append(gs.redo, entry.move)
+	return nil
+}
+
+// Redo повторяет последний отменённый ход.
+func (gs *GameSession) Redo() error {
+	if len(gs.redo) == 0 {
+		return ErrNothingToRedo
+	}
+	move := gs.redo[len(gs.redo)-1]
+	if err := gs.play(&move); err != nil {
+		return err
+	}
+	gs.redo = gs.redo[:len(gs.redo)-1]
+	return nil
+}
+
+// History возвращает сыгранные ходы с начала партии.
+func (gs *GameSession) History() []Move {
+	moves := make([]Move, 0, len(gs.history))
+	for _, entry := range gs.history {
+		moves = append(moves, entry.move)
+	}
+	return moves
+}
+
+// LastMoved возвращает фигуру, сходившую последним ходом, или nil.
+func (gs *GameSession) LastMoved() *PieceID {
+	if gs.lastMoved == nil {
+		return nil
+	}
+	id := gs.lastMoved.ID()
+	return &id
+}
+
+// SetLastMoved отмечает фигуру, сходившую последним ходом, в сессии,
+// восстановленной по состоянию: до следующего хода мокрица её не бросает.
+func (gs *GameSession) SetLastMoved(id *PieceID) {
+	gs.lastMoved = nil
+	if id != nil {
+		gs.lastMoved = gs.board.Piece(*id)
+	}
+}
+
+func (gs *GameSession) play(move *Move) error {
+	piece, err := gs.resolveMove(move)
+	if err != nil {
+		return err
+	}
+	gs.apply(move, piece)
+	return nil
+}
+
+// apply применяет уже проверенный ход. piece — перемещаемая фигура доски
+// или nil для размещения и пропуска хода.
+func (gs *GameSession) apply(move *Move, piece *Piece) {
+	entry := undoEntry{move: Move{Piece: move.Piece, Pass: move.Pass}}
+	if gs.lastMoved != nil {
+		id := gs.lastMoved.ID()
+		entry.lastMoved = &id
+	}
+	gs.history = append(gs.history, entry)
+	history := &gs.history[len(gs.history)-1]
+
+	if move.Pass {
+		gs.lastMoved = nil
+		gs.NextTurn()
+		return
+	}
+
+	position := *move.Position
+	history.move.Position = &position
+	if piece == nil {
+		history.placed = true
+		piece = &Piece{
+			Position: position,
+			Type:     move.Piece.Type,
+			Color:    move.Piece.Color,
+			Placed:   true,
+			Number:   move.Piece.Number,
+		}
+		gs.board.add(piece)
+		gs.GetHand(move.Piece.Color).Pieces[move.Piece.Type] -= 1
+	} else {
+		history.from = piece.Position
+		gs.hash ^= zobristKey(piece)
+		gs.board.moveTo(piece, position)
+	}
+	gs.hash ^= zobristKey(piece)
+
+	gs.lastMoved = piece
+	gs.NextTurn()
+}
+
+// NextNumber возвращает порядковый номер, который получит следующая
+// выставленная фигура цвета color и типа pieceType.
+func (gs *GameSession) NextNumber(color PieceColor, pieceType PieceType) int {
+	number := 1
+	for _, piece := range gs.board.Pieces {
+		if piece.Color == color && piece.Type == pieceType {
+			number += 1
+		}
+	}
+	return number
+}
+
+// LegalMoves возвращает все допустимые ходы стороны, чья сейчас очередь:
+// размещения фигур из руки и перемещения фигур на доске. Если ходов нет,
+// возвращается единственный ход с пропуском.
+func (gs *GameSession) LegalMoves() []Move {
+	if gs.gameOver {
+		return nil
+	}
+
+	color := gs.ColorToMove()
+	hand := gs.GetHand(color)
+	moves := []Move{}
+
+	placements := AvailableToPlace(gs.board, color)
+	for _, pieceType := range PieceTypes {
+		if hand.Pieces[pieceType] <= 0 || gs.queenRequired(hand) && pieceType != QueenBee {
+			continue
+		}
+		if gs.turn < 2 && gs.rules.openingError(pieceType) != nil {
+			continue
+		}
+		id := PieceID{Color: color, Type: pieceType, Number: gs.NextNumber(color, pieceType)}
+		for i := range placements {
+			moves = append(moves, Move{Piece: id, Position: &placements[i]})
+		}
+	}
+
+	if hand.Pieces[QueenBee] == 0 {
+		for _, piece := range gs.board.Pieces {
+			if gs.board.TopPiece(piece.Position) != piece {
+				continue
+			}
+			destinations := gs.destinations(piece, color)
+			for i := range destinations {
+				moves = append(moves, Move{Piece: piece.ID(), Position: &destinations[i]})
+			}
+		}
+	}
+
+	if len(moves) == 0 {
+		moves = append(moves, Move{Pass: true})
+	}
+	return moves
+}
+
+// MustPass сообщает, что у стороны, чья сейчас очередь, нет допустимых ходов.
+func (gs *GameSession) MustPass() bool {
+	moves := gs.LegalMoves()
+	return len(moves) == 1 && moves[0].Pass
+}
+
+// resolveMove проверяет ход и возвращает перемещаемую фигуру доски
+// или nil, если ход является размещением фигуры из руки или пропуском хода.
+func (gs *GameSession) resolveMove(move *Move) (*Piece, error) {
+	if gs.gameOver {
+		return nil, ErrGameOver
+	}
+	if move == nil {
+		return nil, ErrInvalidMove
+	}
+	if move.Pass {
+		if !gs.MustPass() {
+			return nil, ErrPassNotAllowed
+		}
+		return nil, nil
+	}
+	if move.Piece.Number < 1 || move.Position == nil {
+		return nil, ErrInvalidMove
+	}
+
+	color := gs.ColorToMove()
+	hand := gs.GetHand(color)
+
+	piece := gs.board.Piece(move.Piece)
+	if piece == nil {
+		if move.Piece.Color != color {
+			return nil, ErrNotYourTurn
+		}
+		if hand.Pieces[move.Piece.Type] <= 0 {
+			return nil, ErrPieceNotInHand
+		}
+		if move.Piece.Number != gs.NextNumber(color, move.Piece.Type) {
+			return nil, ErrPieceNotFound
+		}
+		if gs.queenRequired(hand) && move.Piece.Type != QueenBee {
+			return nil, fmt.Errorf("%w: не позднее хода %d", ErrQueenRequired, gs.rules.Deadline())
+		}
+		if gs.turn < 2 {
+			if err := gs.rules.openingError(move.Piece.Type); err != nil {
+				return nil, err
+			}
+		}
+		if !containsPosition(AvailableToPlace(gs.board, color), *move.Position) {
+			return nil, ErrIllegalDestination
+		}
+		return nil, nil
+	}
+
+	if hand.Pieces[QueenBee] > 0 {
+		if piece.Color != color {
+			return nil, ErrNotYourPiece
+		}
+		return nil, ErrQueenNotPlaced
+	}
+
+	// Фигуры соперника можно перемещать только способностью мокрицы
+	destinations := gs.destinations(piece, color)
+	if len(destinations) == 0 {
+		switch {
+		case piece.Color != color:
+			return nil, ErrNotYourPiece
+		case gs.board.TopPiece(piece.Position) != piece:
+			return nil, ErrPieceCovered
+		case piece == gs.lastMoved:
+			return nil, ErrPieceFrozen
+		case !CanMove(gs.board, piece):
+			return nil, ErrPiecePinned
+		}
+	}
+	if !containsPosition(destinations, *move.Position) {
+		return nil, ErrIllegalDestination
+	}
+	return piece, nil
+}
+
+// destinations объединяет собственные ходы фигуры piece и её перемещения
+// способностью мокриц стороны color.
+func (gs *GameSession) destinations(piece *Piece, color PieceColor) []Position {
+	positions := []Position{}
+	if piece.Color == color && piece != gs.lastMoved {
+		positions = AvailableToMove(gs.board, piece)
+	}
+	for _, neighbour := range piece.Position.neighbours() {
+		thrower := gs.board.TopPiece(neighbour)
+		if thrower == nil || thrower.Color != color {
+			continue
+		}
+		for _, destination := range PillbugThrows(gs.board, thrower, gs.lastMoved)[piece] {
+			if !containsPosition(positions, destination) {
+				positions = append(positions, destination)
+			}
+		}
+	}
+	return positions
+}
+
+// queenRequired сообщает, что срок выставления королевы улья наступил,
+// а она всё ещё в руке игрока.
+func (gs *GameSession) queenRequired(hand *Hand) bool {
+	return gs.rules.QueenRequired(gs.turn, hand)
+}
+
+func containsPosition(positions []Position, position Position) bool {
+	for _, p := range positions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
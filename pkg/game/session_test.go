@@ -0,0 +1,368 @@
+package game
+
+import (
+	"errors"
+	"testing"
+)
+
+// position восстанавливает сессию по записи состояния в формате State.
+func position(t *testing.T, text string) *GameSession {
+	t.Helper()
+	state, err := ParseState(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGameSessionFromState(Rules{}, state.Board, state.White, state.Black, state.Turn)
+}
+
+func TestQueenSurrounded(t *testing.T) {
+	// Чёрный кузнечик с (2, 4) прыгает через (2, 3) в (2, 2) — единственную
+	// свободную клетку вокруг белой королевы в (2, 1). Во второй позиции
+	// та же клетка последняя свободная и у чёрной королевы в (1, 2)
+	move := Move{Piece: PieceID{Color: Black, Type: Grasshopper, Number: 2}, Position: &Position{X: 2, Y: 2}}
+	for _, c := range []struct {
+		state  string
+		result GameResult
+	}{
+		{"1AS/aBQb/1q1G/1ag/2g - b 5", BlackWon},
+		{"1AS/aBQb/sq1G/1ag/2g - b 5", Draw},
+	} {
+		session := position(t, c.state)
+		if session.IsGameOver() {
+			t.Fatalf("%s: партия окончена до хода", c.state)
+		}
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatalf("%s: %v", c.state, err)
+		}
+		if !session.IsGameOver() || session.Result() != c.result {
+			t.Fatalf("%s: результат %v, ожидался %v", c.state, session.Result(), c.result)
+		}
+		if err := session.ValidateMove(&Move{Pass: true}); err != ErrGameOver {
+			t.Fatalf("%s: ход после конца партии: %v", c.state, err)
+		}
+	}
+}
+
+func place(color PieceColor, pieceType PieceType, number, x, y int) Move {
+	return Move{Piece: PieceID{Color: color, Type: pieceType, Number: number}, Position: &Position{X: x, Y: y}}
+}
+
+// opening — белая и чёрная королевы рядом, затем белый и чёрный муравьи по краям.
+var opening = []Move{
+	place(White, QueenBee, 1, 0, 0),
+	place(Black, QueenBee, 1, 1, 0),
+	place(White, SoldierAnt, 1, -1, 0),
+	place(Black, SoldierAnt, 1, 2, 0),
+}
+
+func TestValidateMoveErrors(t *testing.T) {
+	standard := func(t *testing.T) *GameSession { return NewGameSession(StandardHand) }
+	single := func(t *testing.T) *GameSession {
+		return NewGameSession(func(color PieceColor) *Hand {
+			return &Hand{Pieces: map[PieceType]int{QueenBee: 1, Grasshopper: 1}, Color: color}
+		})
+	}
+	pillbug := func(t *testing.T) *GameSession {
+		session, err := NewGameSessionWithRules(Rules{Expansions: "P"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	for _, c := range []struct {
+		name    string
+		session func(*testing.T) *GameSession
+		moves   []Move
+		move    *Move
+		err     error
+	}{
+		{"пустой ход", standard, nil, nil, ErrInvalidMove},
+		{"без клетки", standard, nil, &Move{Piece: PieceID{Color: White, Type: QueenBee, Number: 1}}, ErrInvalidMove},
+		{"фигура соперника из руки", standard, nil, ptr(place(Black, QueenBee, 1, 0, 0)), ErrNotYourTurn},
+		{"неверный номер", standard, nil, ptr(place(White, SoldierAnt, 2, 0, 0)), ErrPieceNotFound},
+		{"пропуск при ходах", standard, nil, &Move{Pass: true}, ErrPassNotAllowed},
+		{"клетка вне улья", standard, opening, ptr(place(White, Spider, 1, 5, 5)), ErrIllegalDestination},
+		{"рядом с соперником", standard, opening, ptr(place(White, Spider, 1, 1, 1)), ErrIllegalDestination},
+		{"рука пуста", single, []Move{
+			place(White, Grasshopper, 1, 0, 0),
+			place(Black, Grasshopper, 1, 1, 0),
+		}, ptr(place(White, Grasshopper, 2, -1, 0)), ErrPieceNotInHand},
+		{"королева не выставлена", standard, []Move{
+			place(White, Grasshopper, 1, 0, 0),
+			place(Black, Grasshopper, 1, 1, 0),
+		}, ptr(place(White, Grasshopper, 1, 2, 1)), ErrQueenNotPlaced},
+		{"фигура соперника до королевы", standard, []Move{
+			place(White, Grasshopper, 1, 0, 0),
+			place(Black, Grasshopper, 1, 1, 0),
+		}, ptr(place(Black, Grasshopper, 1, -1, 0)), ErrNotYourPiece},
+		{"королева к четвёртому ходу", standard, []Move{
+			place(White, Grasshopper, 1, 0, 0),
+			place(Black, Grasshopper, 1, 1, 0),
+			place(White, SoldierAnt, 1, -1, 0),
+			place(Black, SoldierAnt, 1, 2, 0),
+			place(White, Spider, 1, -2, 0),
+			place(Black, Spider, 1, 3, 0),
+		}, ptr(place(White, SoldierAnt, 2, -3, 0)), ErrQueenRequired},
+		{"фигура соперника", standard, opening, ptr(place(Black, SoldierAnt, 1, 3, 0)), ErrNotYourPiece},
+		{"разрыв улья", standard, opening, ptr(place(White, QueenBee, 1, 0, -1)), ErrPiecePinned},
+		{"накрытая фигура", standard, []Move{
+			place(White, QueenBee, 1, 0, 0),
+			place(Black, QueenBee, 1, 1, 0),
+			place(White, Beetle, 1, -1, 0),
+			place(Black, Beetle, 1, 2, 0),
+			place(White, Beetle, 1, 0, 0),
+			place(Black, Beetle, 1, 1, 0),
+		}, ptr(place(White, QueenBee, 1, 0, 1)), ErrPieceCovered},
+		{"недопустимая клетка", standard, opening, ptr(place(White, SoldierAnt, 1, 5, 5)), ErrIllegalDestination},
+		// Чёрная мокрица бросает белого муравья, и следующим ходом белые
+		// не могут им ходить
+		{"брошенная фигура", pillbug, []Move{
+			place(White, QueenBee, 1, 0, 0),
+			place(Black, Pillbug, 1, 1, 0),
+			place(White, SoldierAnt, 1, -1, 0),
+			place(Black, QueenBee, 1, 2, 0),
+			place(White, SoldierAnt, 1, 1, 1),
+			place(Black, SoldierAnt, 1, 3, 0),
+			place(White, Spider, 1, -1, 0),
+			place(White, SoldierAnt, 1, 1, -1),
+		}, ptr(place(White, SoldierAnt, 1, 2, -1)), ErrPieceFrozen},
+	} {
+		session := c.session(t)
+		for _, move := range c.moves {
+			move := move
+			if err := session.ApplyMove(&move); err != nil {
+				t.Fatalf("%s: ход %+v: %v", c.name, move, err)
+			}
+		}
+		if err := session.ValidateMove(c.move); !errors.Is(err, c.err) {
+			t.Errorf("%s: получена ошибка %v, ожидалась %v", c.name, err, c.err)
+		}
+	}
+}
+
+func ptr(move Move) *Move {
+	return &move
+}
+
+func TestForcedPass(t *testing.T) {
+	// Белая королева в (1, 1) не может проползти в единственную свободную
+	// соседнюю клетку (1, 2): проход закрыт с обеих сторон, а рука пуста
+	session := position(t, "qa/aQb/2g - w 8")
+	moves := session.LegalMoves()
+	if len(moves) != 1 || !moves[0].Pass || !session.MustPass() {
+		t.Fatalf("допустимые ходы %+v, ожидался только пропуск", moves)
+	}
+	if err := session.ValidateMove(&Move{Piece: PieceID{Color: White, Type: QueenBee, Number: 1}, Position: &Position{X: 1, Y: 2}}); err != ErrIllegalDestination {
+		t.Fatalf("ход королевы: %v", err)
+	}
+	if err := session.ApplyMove(&Move{Pass: true}); err != nil {
+		t.Fatal(err)
+	}
+	if session.GetTurn() != 15 || session.ColorToMove() != Black {
+		t.Fatalf("после пропуска ход %d", session.GetTurn())
+	}
+
+	// У чёрных ходы есть, и пропустить ход они не могут
+	if session.MustPass() {
+		t.Fatal("чёрные тоже вынуждены пропустить ход")
+	}
+	if err := session.ValidateMove(&Move{Pass: true}); err != ErrPassNotAllowed {
+		t.Fatalf("пропуск при допустимых ходах: %v", err)
+	}
+}
+
+func TestBeetleStack(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	whiteBeetle := PieceID{Color: White, Type: Beetle, Number: 1}
+	for _, step := range []struct {
+		move Move
+		// Высота стопки в клетке at и уровень белого жука после хода
+		at     Position
+		height int
+		level  int
+	}{
+		{place(White, QueenBee, 1, 0, 0), Position{0, 0}, 1, -1},
+		{place(Black, QueenBee, 1, 1, 0), Position{1, 0}, 1, -1},
+		{place(White, Beetle, 1, -1, 0), Position{-1, 0}, 1, 0},
+		{place(Black, Beetle, 1, 2, 0), Position{2, 0}, 1, 0},
+		{place(White, Beetle, 1, 0, 0), Position{0, 0}, 2, 1},
+		{place(Black, Beetle, 1, 1, 0), Position{1, 0}, 2, 1},
+		{place(White, Beetle, 1, 1, 0), Position{1, 0}, 3, 2},
+		// Верхние фигуры чёрных накрыты, выставить фигуру некуда
+		{Move{Pass: true}, Position{0, 0}, 1, 2},
+		{place(White, Beetle, 1, 1, 1), Position{1, 0}, 2, 0},
+	} {
+		move := step.move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatalf("ход %+v: %v", move, err)
+		}
+		board := session.GetBoard()
+		if height := board.Height(step.at); height != step.height {
+			t.Fatalf("ход %+v: высота %v — %d, ожидалась %d", move, step.at, height, step.height)
+		}
+		beetle := board.Piece(whiteBeetle)
+		if beetle != nil && beetle.Level != step.level {
+			t.Fatalf("ход %+v: уровень жука %d, ожидался %d", move, beetle.Level, step.level)
+		}
+		for _, stack := range board.grid().stacks {
+			for level, piece := range stack {
+				if piece.Level != level {
+					t.Fatalf("ход %+v: фигура %+v лежит на уровне %d", move, *piece, level)
+				}
+			}
+		}
+	}
+
+	board := session.GetBoard()
+	if top := board.TopPiece(Position{1, 0}); top.ID() != (PieceID{Color: Black, Type: Beetle, Number: 1}) {
+		t.Fatalf("после спуска жука наверху %+v", top.ID())
+	}
+	if err := session.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if beetle := board.Piece(whiteBeetle); beetle.Level != 2 || board.TopPiece(Position{1, 0}) != beetle {
+		t.Fatalf("отмена спуска вернула жука на уровень %d", beetle.Level)
+	}
+}
+
+func TestSetLastMoved(t *testing.T) {
+	// Белый муравей только что пришёл в (1, 1), и чёрная мокрица в (1, 0)
+	// не может его бросить, пока он последний сходивший
+	session, err := NewGameSessionWithRules(Rules{Expansions: "P"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, move := range []Move{
+		place(White, QueenBee, 1, 0, 0),
+		place(Black, Pillbug, 1, 1, 0),
+		place(White, SoldierAnt, 1, -1, 0),
+		place(Black, QueenBee, 1, 2, 0),
+		place(White, SoldierAnt, 1, 1, 1),
+	} {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatalf("ход %+v: %v", move, err)
+		}
+	}
+	ant := PieceID{Color: White, Type: SoldierAnt, Number: 1}
+	if last := session.LastMoved(); last == nil || *last != ant {
+		t.Fatalf("последней сходила %+v", last)
+	}
+	throw := place(White, SoldierAnt, 1, 1, -1)
+	if err := session.ValidateMove(&throw); err == nil {
+		t.Fatal("мокрица бросает только что сходившую фигуру")
+	}
+
+	restore := func(last *PieceID) *GameSession {
+		clone := session.Clone()
+		restored := NewGameSessionFromState(clone.Rules(), clone.GetBoard(), clone.GetWhiteHand(), clone.GetBlackHand(), clone.GetTurn())
+		restored.SetLastMoved(last)
+		return restored
+	}
+	if err := restore(session.LastMoved()).ValidateMove(&throw); err == nil {
+		t.Fatal("восстановленная сессия забыла последний ход")
+	}
+	if err := restore(nil).ValidateMove(&throw); err != nil {
+		t.Fatalf("бросок без последнего хода: %v", err)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	moves := append(append([]Move{}, opening...),
+		place(White, SoldierAnt, 1, 0, -1),
+		place(Black, SoldierAnt, 1, 1, 1),
+	)
+	// Хэш и последняя сходившая фигура до каждого хода
+	hashes := []uint64{session.Hash()}
+	lastMoved := []*PieceID{nil}
+	for _, move := range moves {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatalf("ход %+v: %v", move, err)
+		}
+		hashes = append(hashes, session.Hash())
+		lastMoved = append(lastMoved, session.LastMoved())
+	}
+
+	for i := len(moves) - 1; i >= 0; i-- {
+		if err := session.Undo(); err != nil {
+			t.Fatal(err)
+		}
+		if session.Hash() != hashes[i] {
+			t.Fatalf("после отмены хода %d хэш не восстановлен", i)
+		}
+		clone := session.Clone()
+		fresh := NewGameSessionFromState(clone.Rules(), clone.GetBoard(), clone.GetWhiteHand(), clone.GetBlackHand(), clone.GetTurn())
+		if session.Hash() != fresh.Hash() {
+			t.Fatalf("после отмены хода %d хэш отличается от вычисленного заново", i)
+		}
+		if last := session.LastMoved(); (last == nil) != (lastMoved[i] == nil) || last != nil && *last != *lastMoved[i] {
+			t.Fatalf("после отмены хода %d последней сходила %+v, ожидалась %+v", i, last, lastMoved[i])
+		}
+	}
+	if err := session.Undo(); err != ErrNothingToUndo {
+		t.Fatalf("отмена в начале партии: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := session.Redo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if session.Hash() != hashes[2] || *session.LastMoved() != moves[1].Piece {
+		t.Fatal("повтор не восстановил позицию")
+	}
+
+	// Новый ход отменяет возможность повторить отменённые
+	move := place(White, Spider, 1, -1, 0)
+	if err := session.ApplyMove(&move); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Redo(); err != ErrNothingToRedo {
+		t.Fatalf("повтор после нового хода: %v", err)
+	}
+}
+
+func TestThreefoldRepetition(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	for _, move := range opening {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := session.Hash()
+	// Муравьи уходят из исходных клеток и возвращаются, повторяя позицию
+	cycle := []Move{
+		place(White, SoldierAnt, 1, 0, -1),
+		place(Black, SoldierAnt, 1, 2, 1),
+		place(White, SoldierAnt, 1, -1, 0),
+		place(Black, SoldierAnt, 1, 2, 0),
+	}
+	for repetition := 2; repetition <= 3; repetition++ {
+		for _, move := range cycle {
+			move := move
+			if err := session.ApplyMove(&move); err != nil {
+				t.Fatalf("повторение %d, ход %+v: %v", repetition, move, err)
+			}
+		}
+		if session.Hash() != start || session.Repetitions() != repetition {
+			t.Fatalf("позиция повторилась %d раз, ожидалось %d", session.Repetitions(), repetition)
+		}
+		if repetition == 2 && session.IsGameOver() {
+			t.Fatal("партия окончена после второго повторения")
+		}
+	}
+	if !session.IsGameOver() || session.Result() != Draw {
+		t.Fatalf("после третьего повторения результат %v", session.Result())
+	}
+
+	// Отмена последнего хода снимает ничью: предыдущая позиция встречалась дважды
+	if err := session.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if session.IsGameOver() || session.Repetitions() != 2 {
+		t.Fatalf("после отмены результат %v, повторений %d", session.Result(), session.Repetitions())
+	}
+}
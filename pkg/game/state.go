@@ -0,0 +1,299 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrBadState = errors.New("некорректная запись позиции")
+
+// State — состояние партии без истории ходов: доска, руки игроков и номер
+// полухода. Последняя сдвинутая фигура, которую нельзя трогать мокрицей,
+// в состояние не входит, как и в NewGameSessionFromState.
+//
+// Состояние записывается одной строкой, по аналогии с FEN в шахматах:
+//
+//	1QM/1(PB)/1q/sa/1g SSBGGGAAALsbbggaamlp b 5
+//
+// Первое поле — доска по строкам клеток с одинаковой координатой Y через
+// косую черту, клетки строки идут по возрастанию X. Фигуры обозначаются
+// буквами Q S B G A M L P, заглавными у белых и строчными у чёрных,
+// стопка — буквами снизу вверх в скобках, цифры — число пустых клеток.
+// Пустые клетки в конце строки не пишутся, пустая доска записывается "-".
+// Второе поле — фигуры в руках, сначала белые, затем чёрные, или "-".
+// Дальше идут очередь хода w или b и номер хода игрока, начиная с 1.
+type State struct {
+	Board *Board
+	White *Hand
+	Black *Hand
+	Turn  int
+}
+
+var pieceLetters = [...]byte{
+	QueenBee:    'Q',
+	Spider:      'S',
+	Beetle:      'B',
+	Grasshopper: 'G',
+	SoldierAnt:  'A',
+	Mosquito:    'M',
+	Ladybug:     'L',
+	Pillbug:     'P',
+}
+
+// State возвращает текущее состояние партии.
+func (gs *GameSession) State() State {
+	return State{Board: gs.board, White: gs.white, Black: gs.black, Turn: gs.turn}
+}
+
+// String записывает состояние в нормализованном виде: доска приводится
+// к канонической форме Canonical. Поэтому позиции, совпадающие с точностью
+// до сдвига, поворота, отражения и нумерации одинаковых фигур, записываются
+// одинаково.
+func (s State) String() string {
+	board := "-"
+	if len(s.Board.Pieces) > 0 {
+		_, board = canonicalTransform(s.Board)
+	}
+
+	hands := encodeHand(s.White, unicode.ToUpper) + encodeHand(s.Black, unicode.ToLower)
+	if hands == "" {
+		hands = "-"
+	}
+
+	side := "w"
+	if s.Turn%2 == 1 {
+		side = "b"
+	}
+	return strings.Join([]string{board, hands, side, strconv.Itoa(s.Turn/2 + 1)}, " ")
+}
+
+// encodeBoard записывает доску, перенесённую преобразованием t без учёта
+// сдвига, и возвращает вместе с записью её левую верхнюю клетку.
+func encodeBoard(board *Board, t Transform) (string, Position) {
+	stacks := map[Position][]*Piece{}
+	first := true
+	var min, max Position
+	for _, stack := range board.grid().stacks {
+		position := t.Apply(stack[0].Position)
+		stacks[position] = stack
+		if first || position.X < min.X {
+			min.X = position.X
+		}
+		if first || position.Y < min.Y {
+			min.Y = position.Y
+		}
+		if first || position.X > max.X {
+			max.X = position.X
+		}
+		if first || position.Y > max.Y {
+			max.Y = position.Y
+		}
+		first = false
+	}
+
+	var b strings.Builder
+	for y := min.Y; y <= max.Y; y++ {
+		if y > min.Y {
+			b.WriteByte('/')
+		}
+		empty := 0
+		for x := min.X; x <= max.X; x++ {
+			stack := stacks[Position{X: x, Y: y}]
+			if len(stack) == 0 {
+				empty += 1
+				continue
+			}
+			if empty > 0 {
+				b.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			if len(stack) > 1 {
+				b.WriteByte('(')
+			}
+			for _, piece := range stack {
+				b.WriteByte(pieceLetter(piece.Type, piece.Color))
+			}
+			if len(stack) > 1 {
+				b.WriteByte(')')
+			}
+		}
+	}
+	return b.String(), min
+}
+
+func encodeHand(hand *Hand, letterCase func(rune) rune) string {
+	var b strings.Builder
+	for _, pieceType := range PieceTypes {
+		for i := 0; i < hand.Pieces[pieceType]; i++ {
+			b.WriteRune(letterCase(rune(pieceLetters[pieceType])))
+		}
+	}
+	return b.String()
+}
+
+func pieceLetter(pieceType PieceType, color PieceColor) byte {
+	letter := pieceLetters[pieceType]
+	if color == Black {
+		letter += 'a' - 'A'
+	}
+	return letter
+}
+
+func parsePieceLetter(letter rune) (PieceType, PieceColor, bool) {
+	color := White
+	if unicode.IsLower(letter) {
+		color = Black
+	}
+	for pieceType, l := range pieceLetters {
+		if rune(l) == unicode.ToUpper(letter) {
+			return PieceType(pieceType), color, true
+		}
+	}
+	return 0, 0, false
+}
+
+// ParseState разбирает состояние, записанное методом String. Левая верхняя
+// клетка записи получает координаты (0, 0), одинаковые фигуры нумеруются
+// в порядке записи. Расширение считается участвующим в партии, если его
+// насекомое есть на доске или в руке хотя бы одного игрока.
+func ParseState(text string) (State, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 4 {
+		return State{}, fmt.Errorf("%w: ожидается четыре поля, получено %d", ErrBadState, len(fields))
+	}
+
+	board, err := parseBoard(fields[0])
+	if err != nil {
+		return State{}, err
+	}
+	white, black, err := parseHands(fields[1], board)
+	if err != nil {
+		return State{}, err
+	}
+
+	move, err := strconv.Atoi(fields[3])
+	if err != nil || move < 1 {
+		return State{}, fmt.Errorf("%w: номер хода %q", ErrBadState, fields[3])
+	}
+	turn := (move - 1) * 2
+	switch fields[2] {
+	case "w":
+	case "b":
+		turn += 1
+	default:
+		return State{}, fmt.Errorf("%w: очередь хода %q", ErrBadState, fields[2])
+	}
+
+	return State{Board: board, White: white, Black: black, Turn: turn}, nil
+}
+
+func parseBoard(field string) (*Board, error) {
+	board := &Board{}
+	if field == "-" {
+		return board, nil
+	}
+
+	numbers := map[PieceID]int{}
+	place := func(letter rune, position Position, level int) error {
+		pieceType, color, ok := parsePieceLetter(letter)
+		if !ok {
+			return fmt.Errorf("%w: неизвестная фигура %q", ErrBadState, letter)
+		}
+		key := PieceID{Color: color, Type: pieceType}
+		numbers[key] += 1
+		board.Pieces = append(board.Pieces, &Piece{
+			Position: position,
+			Type:     pieceType,
+			Color:    color,
+			Placed:   true,
+			Level:    level,
+			Number:   numbers[key],
+		})
+		return nil
+	}
+
+	for y, row := range strings.Split(field, "/") {
+		runes := []rune(row)
+		x := 0
+		for i := 0; i < len(runes); i++ {
+			switch {
+			case unicode.IsDigit(runes[i]):
+				j := i
+				for j < len(runes) && unicode.IsDigit(runes[j]) {
+					j += 1
+				}
+				empty, err := strconv.Atoi(string(runes[i:j]))
+				if err != nil || empty == 0 {
+					return nil, fmt.Errorf("%w: строка доски %q", ErrBadState, row)
+				}
+				x += empty
+				i = j - 1
+			case runes[i] == '(':
+				end := i + 1
+				for end < len(runes) && runes[end] != ')' {
+					end += 1
+				}
+				if end == len(runes) || end == i+1 {
+					return nil, fmt.Errorf("%w: стопка в строке доски %q", ErrBadState, row)
+				}
+				for level, letter := range runes[i+1 : end] {
+					if err := place(letter, Position{X: x, Y: y}, level); err != nil {
+						return nil, err
+					}
+				}
+				x += 1
+				i = end
+			default:
+				if err := place(runes[i], Position{X: x, Y: y}, 0); err != nil {
+					return nil, err
+				}
+				x += 1
+			}
+		}
+	}
+	return board, nil
+}
+
+func parseHands(field string, board *Board) (*Hand, *Hand, error) {
+	white, black := StandardHand(White), StandardHand(Black)
+	for _, hand := range []*Hand{white, black} {
+		for pieceType := range hand.Pieces {
+			hand.Pieces[pieceType] = 0
+		}
+	}
+
+	inPlay := map[PieceType]bool{}
+	for _, piece := range board.Pieces {
+		inPlay[piece.Type] = true
+	}
+	if field != "-" {
+		for _, letter := range field {
+			pieceType, color, ok := parsePieceLetter(letter)
+			if !ok {
+				return nil, nil, fmt.Errorf("%w: неизвестная фигура в руке %q", ErrBadState, letter)
+			}
+			inPlay[pieceType] = true
+			if color == White {
+				white.Pieces[pieceType] += 1
+			} else {
+				black.Pieces[pieceType] += 1
+			}
+		}
+	}
+
+	// Насекомые расширений, участвующих в партии, остаются в руке и с нулём
+	for _, expansion := range expansionPieces {
+		if !inPlay[expansion.pieceType] {
+			continue
+		}
+		for _, hand := range []*Hand{white, black} {
+			if _, ok := hand.Pieces[expansion.pieceType]; !ok {
+				hand.Pieces[expansion.pieceType] = 0
+			}
+		}
+	}
+	return white, black, nil
+}
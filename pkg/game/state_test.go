@@ -0,0 +1,84 @@
+package game
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	randomGames(t, 20, func(t *testing.T, session *GameSession, r *rand.Rand) {
+		state := session.State()
+		text := state.String()
+		parsed, err := ParseState(text)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if again := parsed.String(); again != text {
+			t.Fatalf("запись %q после разбора стала %q", text, again)
+		}
+
+		// Сдвинутая, повёрнутая или отражённая позиция записывается так же
+		transform := Transform{
+			Mirrored: r.Intn(2) == 1,
+			Rotation: r.Intn(6),
+			Offset:   Position{X: r.Intn(9) - 4, Y: r.Intn(9) - 4},
+		}
+		state.Board = transform.Board(state.Board)
+		if other := state.String(); other != text {
+			t.Fatalf("преобразование %+v: %q, ожидалось %q", transform, other, text)
+		}
+	})
+}
+
+func TestParseStateErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"Q qx w 1",
+		"Qx - w 1",
+		"Q() - b 1",
+		"(Qq - b 1",
+		"Q - x 1",
+		"Q - w 0",
+	} {
+		if _, err := ParseState(text); err == nil {
+			t.Errorf("ParseState(%q) не вернула ошибку", text)
+		}
+	}
+}
+
+func TestStateKnown(t *testing.T) {
+	session := NewGameSession(StandardHand)
+	moves := append(append([]Move{}, opening...),
+		place(White, Beetle, 1, -1, -1),
+		place(Black, Beetle, 1, 2, 1),
+		place(White, Beetle, 1, 0, 0),
+	)
+	for _, c := range []struct {
+		plies int
+		state string
+	}{
+		{0, "- QSSBBGGGAAAqssbbgggaaa w 1"},
+		// Ряд из четырёх фигур записывается по диагонали: так запись
+		// лексикографически меньше
+		{4, "A/1Q/2q/3a SSBBGGGAAssbbgggaa w 3"},
+		// Белый жук на белой королеве, чёрный жук рядом с чёрной королевой
+		{7, "1A/1(QB)/bq/1a SSBGGGAAssbgggaa b 4"},
+	} {
+		for len(session.History()) < c.plies {
+			move := moves[len(session.History())]
+			if err := session.ApplyMove(&move); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if text := session.State().String(); text != c.state {
+			t.Fatalf("после %d ходов позиция записана как %q, ожидалось %q", c.plies, text, c.state)
+		}
+		state, err := ParseState(c.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.Board.Pieces) != len(session.GetBoard().Pieces) || state.Turn != session.GetTurn() {
+			t.Fatalf("%q: разобрано %d фигур, ход %d", c.state, len(state.Board.Pieces), state.Turn)
+		}
+	}
+}
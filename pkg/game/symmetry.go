@@ -0,0 +1,90 @@
+package game
+
+// Transform — преобразование шестиугольной сетки, сохраняющее соседство
+// клеток: отражение относительно диагонали X = Y, если Mirrored, затем
+// Rotation поворотов на 60° в порядке обхода направлений directions и
+// сдвиг на Offset. Двенадцать сочетаний отражения и поворота образуют все
+// симметрии сетки.
+type Transform struct {
+	Mirrored bool
+	Rotation int
+	Offset   Position
+}
+
+// Apply переносит клетку position.
+func (t Transform) Apply(position Position) Position {
+	if t.Mirrored {
+		position = Position{X: position.Y, Y: position.X}
+	}
+	for i := 0; i < (t.Rotation%6+6)%6; i++ {
+		position = Position{X: position.X - position.Y, Y: position.X}
+	}
+	return position.Add(t.Offset)
+}
+
+// Inverse возвращает обратное преобразование.
+func (t Transform) Inverse() Transform {
+	// Отражение меняет направление поворотов: после него поворот на k шагов
+	// отменяется тем же поворотом и повторным отражением
+	inverse := Transform{Mirrored: t.Mirrored, Rotation: t.Rotation}
+	if !t.Mirrored {
+		inverse.Rotation = -t.Rotation
+	}
+	offset := inverse.Apply(t.Offset)
+	inverse.Offset = Position{X: -offset.X, Y: -offset.Y}
+	return inverse
+}
+
+// Board возвращает копию доски board, перенесённую преобразованием.
+// Порядок фигур и высоты в стопках сохраняются.
+func (t Transform) Board(board *Board) *Board {
+	moved := &Board{Pieces: make([]*Piece, 0, len(board.Pieces))}
+	for _, piece := range board.Pieces {
+		copied := *piece
+		copied.Position = t.Apply(piece.Position)
+		moved.Pieces = append(moved.Pieces, &copied)
+	}
+	return moved
+}
+
+// Translate возвращает копию доски, сдвинутую на offset.
+func Translate(board *Board, offset Position) *Board {
+	return Transform{Offset: offset}.Board(board)
+}
+
+// Rotate возвращает копию доски, повёрнутую на steps × 60° вокруг клетки (0, 0).
+func Rotate(board *Board, steps int) *Board {
+	return Transform{Rotation: steps}.Board(board)
+}
+
+// Mirror возвращает копию доски, отражённую относительно диагонали X = Y.
+func Mirror(board *Board) *Board {
+	return Transform{Mirrored: true}.Board(board)
+}
+
+// Canonical возвращает каноническую форму доски и преобразование, которое
+// переводит в неё клетки исходной доски. Доски, совпадающие с точностью
+// до сдвига, поворота и отражения, имеют одинаковую каноническую форму;
+// её левая верхняя клетка в записи State находится в (0, 0). Порядковые
+// номера фигур сохраняются, но на форму не влияют.
+func Canonical(board *Board) (*Board, Transform) {
+	t, _ := canonicalTransform(board)
+	return t.Board(board), t
+}
+
+// canonicalTransform перебирает двенадцать симметрий и выбирает ту, при
+// которой запись доски наименьшая. Вместе с преобразованием возвращается
+// запись доски.
+func canonicalTransform(board *Board) (Transform, string) {
+	var best Transform
+	encoding := ""
+	for symmetry := 0; symmetry < 12; symmetry++ {
+		t := Transform{Mirrored: symmetry >= 6, Rotation: symmetry % 6}
+		encoded, min := encodeBoard(board, t)
+		if symmetry == 0 || encoded < encoding {
+			t.Offset = Position{X: -min.X, Y: -min.Y}
+			best, encoding = t, encoded
+		}
+	}
+	return best, encoding
+}
@@ -0,0 +1,104 @@
+package game
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomTransform(r *rand.Rand) Transform {
+	return Transform{
+		Mirrored: r.Intn(2) == 1,
+		Rotation: r.Intn(12) - 6,
+		Offset:   Position{X: r.Intn(9) - 4, Y: r.Intn(9) - 4},
+	}
+}
+
+func TestTransform(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		transform := randomTransform(r)
+		position := Position{X: r.Intn(21) - 10, Y: r.Intn(21) - 10}
+		if back := transform.Inverse().Apply(transform.Apply(position)); back != position {
+			t.Fatalf("%+v: клетка %v вернулась в %v", transform, position, back)
+		}
+		for _, neighbour := range Neighbours(position) {
+			if !IsPositionNeignbour(transform.Apply(position), transform.Apply(neighbour)) {
+				t.Fatalf("%+v не сохраняет соседство %v и %v", transform, position, neighbour)
+			}
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	randomGames(t, 5, func(t *testing.T, session *GameSession, r *rand.Rand) {
+		i := session.GetTurn()
+		board := session.GetBoard()
+		canonical, transform := Canonical(board)
+		_, encoding := canonicalTransform(board)
+		if encoded, min := encodeBoard(canonical, Transform{}); encoded != encoding || len(board.Pieces) > 0 && min != (Position{}) {
+			t.Fatalf("ход %d: каноническая форма %q, смещение %v, ожидалась %q", i, encoded, min, encoding)
+		}
+
+		// Симметричные позиции дают одинаковую каноническую форму; при
+		// симметрии самой доски фигуры в ней могут поменяться местами
+		moved := randomTransform(r).Board(board)
+		other, _ := Canonical(moved)
+		if encoded, _ := encodeBoard(other, Transform{}); encoded != encoding {
+			t.Fatalf("ход %d: канонические формы %q и %q различаются", i, encoded, encoding)
+		}
+		for j, piece := range board.Pieces {
+			if canonical.Pieces[j].Position != transform.Apply(piece.Position) {
+				t.Fatalf("ход %d: преобразование не соответствует канонической форме", i)
+			}
+		}
+
+		// Число допустимых ходов не зависит от расположения улья
+		white, black := session.GetWhiteHand(), session.GetBlackHand()
+		want := len(NewGameSessionFromState(Rules{}, board, white, black, session.GetTurn()).LegalMoves())
+		if got := len(NewGameSessionFromState(Rules{}, moved, white, black, session.GetTurn()).LegalMoves()); got != want {
+			t.Fatalf("ход %d: после преобразования %d допустимых ходов вместо %d", i, got, want)
+		}
+	})
+}
+
+func TestTransformKnown(t *testing.T) {
+	// Поворот на 60° переводит каждое направление в следующее по кругу
+	for d, direction := range directions {
+		next := directions[(d+1)%6]
+		if rotated := (Transform{Rotation: 1}).Apply(direction); rotated != next {
+			t.Fatalf("поворот %v: %v, ожидалось %v", direction, rotated, next)
+		}
+	}
+	for _, c := range []struct {
+		transform Transform
+		from, to  Position
+	}{
+		{Transform{Mirrored: true}, Position{X: 1, Y: 0}, Position{X: 0, Y: 1}},
+		{Transform{Rotation: 2}, Position{X: 2, Y: 1}, Position{X: -1, Y: 1}},
+		{Transform{Rotation: -1}, Position{X: 1, Y: 1}, Position{X: 1, Y: 0}},
+		// Сдвиг применяется после отражения и поворота
+		{Transform{Mirrored: true, Rotation: 1, Offset: Position{X: 2, Y: 3}}, Position{X: 1, Y: 0}, Position{X: 1, Y: 3}},
+	} {
+		if to := c.transform.Apply(c.from); to != c.to {
+			t.Errorf("%+v: %v перешла в %v, ожидалось %v", c.transform, c.from, to, c.to)
+		}
+	}
+
+	// Ряд фигур вдоль оси X после поворота лежит на диагонали
+	session := NewGameSession(StandardHand)
+	for _, move := range opening {
+		move := move
+		if err := session.ApplyMove(&move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated := Rotate(session.GetBoard(), 1)
+	for i, want := range []Position{{X: 0, Y: 0}, {X: 1, Y: 1}, {X: -1, Y: -1}, {X: 2, Y: 2}} {
+		if piece := rotated.Pieces[i]; piece.Position != want || piece.ID() != opening[i].Piece {
+			t.Errorf("после поворота %+v в %v, ожидалась %v", piece.ID(), piece.Position, want)
+		}
+	}
+	if back := Rotate(rotated, 5); back.Pieces[3].Position != *opening[3].Position {
+		t.Fatalf("шесть поворотов не вернули доску: %v", back.Pieces[3].Position)
+	}
+}
@@ -0,0 +1,35 @@
+package game
+
+// Ключи Zobrist не хранятся в таблице, как в шахматах: поле Hive не ограничено,
+// поэтому ключ фигуры получается перемешиванием её типа, цвета, клетки и
+// высоты в стопке. Порядковый номер в ключ не входит: позиции, отличающиеся
+// только перестановкой одинаковых фигур, совпадают.
+
+// blackToMoveKey добавляется к хэшу позиции, когда очередь хода у чёрных.
+var blackToMoveKey = mix64(0x9e3779b97f4a7c15)
+
+// mix64 — финальное перемешивание splitmix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// zobristKey возвращает ключ фигуры piece в её текущей клетке и на текущей высоте.
+func zobristKey(piece *Piece) uint64 {
+	cell := uint64(uint32(int32(piece.Position.X))) | uint64(uint32(int32(piece.Position.Y)))<<32
+	kind := uint64(piece.Type) | uint64(piece.Color)<<8 | uint64(piece.Level)<<16
+	return mix64(cell ^ mix64(kind+1))
+}
+
+// Hash возвращает хэш Zobrist расположения фигур на доске без учёта очереди хода.
+func (b *Board) Hash() uint64 {
+	var hash uint64
+	for _, piece := range b.Pieces {
+		hash ^= zobristKey(piece)
+	}
+	return hash
+}
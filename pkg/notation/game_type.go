@@ -0,0 +1,158 @@
+package notation
+
+import (
+	"fmt"
+	"hive/pkg/game"
+	"strconv"
+	"strings"
+)
+
+// ParseGameType разбирает строку типа игры UHP, например "Base+MLP",
+// и возвращает буквы расширений.
+func ParseGameType(gameType string) (string, error) {
+	expansions, ok := strings.CutPrefix(gameType, "Base")
+	if !ok {
+		return "", fmt.Errorf("неизвестный тип игры %q", gameType)
+	}
+	if expansions != "" {
+		if expansions, ok = strings.CutPrefix(expansions, "+"); !ok || expansions == "" {
+			return "", fmt.Errorf("неизвестный тип игры %q", gameType)
+		}
+	}
+	if _, err := game.ExpansionHand(expansions); err != nil {
+		return "", err
+	}
+	return expansions, nil
+}
+
+// FormatRules записывает вариант правил строкой типа игры UHP, к которой
+// через запятую добавлены отличия от стандартных правил:
+//
+//	tournament      королеву улья нельзя выставлять первым ходом
+//	queen=N         королеву улья нужно выставить не позднее хода N
+//	openings=SBG    первым ходом можно выставить только перечисленных насекомых
+//
+// Например, "Base+MLP,tournament,queen=3". Для стандартных правил получается
+// обычная строка типа игры UHP.
+func FormatRules(rules game.Rules) string {
+	gameType := "Base"
+	expansions := ""
+	for _, letter := range "MLP" {
+		if strings.ContainsRune(rules.Expansions, letter) {
+			expansions += string(letter)
+		}
+	}
+	if expansions != "" {
+		gameType += "+" + expansions
+	}
+
+	parts := []string{gameType}
+	if rules.Tournament {
+		parts = append(parts, "tournament")
+	}
+	if rules.Deadline() != game.DefaultQueenDeadline {
+		parts = append(parts, fmt.Sprintf("queen=%d", rules.Deadline()))
+	}
+	if len(rules.Openings) > 0 {
+		openings := ""
+		for _, pieceType := range game.PieceTypes {
+			for _, allowed := range rules.Openings {
+				if allowed == pieceType {
+					openings += string(typeLetters[pieceType])
+					break
+				}
+			}
+		}
+		parts = append(parts, "openings="+openings)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseRules разбирает вариант правил в записи FormatRules и проверяет его.
+func ParseRules(text string) (game.Rules, error) {
+	fields := strings.Split(text, ",")
+	expansions, err := ParseGameType(fields[0])
+	if err != nil {
+		return game.Rules{}, err
+	}
+
+	rules := game.Rules{Expansions: expansions}
+	for _, option := range fields[1:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "tournament":
+			rules.Tournament = true
+		case "queen":
+			if rules.QueenDeadline, err = strconv.Atoi(value); err != nil || rules.QueenDeadline < 1 {
+				return game.Rules{}, fmt.Errorf("некорректный срок выставления королевы улья %q", value)
+			}
+		case "openings":
+			for _, letter := range value {
+				pieceType, ok := pieceTypeOf(letter)
+				if !ok {
+					return game.Rules{}, fmt.Errorf("неизвестный тип насекомого %q", letter)
+				}
+				rules.Openings = append(rules.Openings, pieceType)
+			}
+		default:
+			return game.Rules{}, fmt.Errorf("неизвестное правило %q", option)
+		}
+	}
+	if err = rules.Validate(); err != nil {
+		return game.Rules{}, err
+	}
+	return rules, nil
+}
+
+// ParseGameString восстанавливает партию по строке типа игры, например
+// "Base+MLP", или по строке партии UHP вида "Base+M;InProgress;White[2];wS1;bG1 -wS1".
+// Вместо типа игры можно указать вариант правил в записи FormatRules.
+// Вместе с сессией возвращаются сыгранные ходы в нормализованной записи.
+func ParseGameString(gameString string) (*game.GameSession, []string, error) {
+	fields := strings.Split(gameString, ";")
+	rules, err := ParseRules(fields[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) == 2 {
+		return nil, nil, fmt.Errorf("некорректная строка партии %q", gameString)
+	}
+
+	session, err := game.NewGameSessionWithRules(rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	var moves []string
+	if len(fields) > 3 {
+		for _, move := range fields[3:] {
+			parsed, err := ParseMove(session, move)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ход %q: %w", move, err)
+			}
+			normalized, err := FormatMove(session, parsed)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ход %q: %w", move, err)
+			}
+			if err = session.ApplyMove(parsed); err != nil {
+				return nil, nil, fmt.Errorf("ход %q: %w", move, err)
+			}
+			moves = append(moves, normalized)
+		}
+	}
+	return session, moves, nil
+}
+
+// GameString записывает партию строкой UHP: тип игры, состояние, очередь
+// хода и сыгранные ходы moves.
+func GameString(gameType string, session *game.GameSession, moves []string) string {
+	state := session.Result().String()
+	if len(moves) == 0 {
+		state = "NotStarted"
+	}
+	side := "White"
+	if !session.WhiteToMove() {
+		side = "Black"
+	}
+	parts := []string{gameType, state, fmt.Sprintf("%s[%d]", side, session.GetTurn()/2+1)}
+	return strings.Join(append(parts, moves...), ";")
+}
@@ -0,0 +1,239 @@
+// Package notation переводит ходы пакета game в стандартную нотацию Hive,
+// принятую в BoardSpace и Universal Hive Protocol, и обратно.
+//
+// Ход записывается именем фигуры и клеткой назначения относительно другой
+// фигуры: "wS1 -bQ" — белый паук 1 слева от чёрной королевы, "bB2 wA1" —
+// чёрный жук 2 на белом муравье 1, "pass" — пропуск хода. Первый ход партии
+// записывается одним именем фигуры.
+package notation
+
+import (
+	"errors"
+	"fmt"
+	"hive/pkg/game"
+	"strconv"
+	"strings"
+)
+
+const Pass = "pass"
+
+var (
+	ErrUnknownColor  = errors.New("неизвестный цвет фигуры")
+	ErrUnknownPiece  = errors.New("неизвестный тип фигуры")
+	ErrBadNumber     = errors.New("некорректный порядковый номер фигуры")
+	ErrNotOnBoard    = errors.New("фигуры нет на доске")
+	ErrNoDestination = errors.New("не указана клетка назначения")
+	ErrTooManyTokens = errors.New("ход состоит не более чем из двух частей")
+	ErrNoReference   = errors.New("рядом с клеткой назначения нет фигур")
+)
+
+// ParseError сообщает, какая часть записи хода не разобрана.
+type ParseError struct {
+	Token string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%q: %v", e.Token, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var typeLetters = map[game.PieceType]byte{
+	game.QueenBee:    'Q',
+	game.Spider:      'S',
+	game.Beetle:      'B',
+	game.Grasshopper: 'G',
+	game.SoldierAnt:  'A',
+	game.Mosquito:    'M',
+	game.Ladybug:     'L',
+	game.Pillbug:     'P',
+}
+
+func pieceTypeOf(letter rune) (game.PieceType, bool) {
+	for pieceType, l := range typeLetters {
+		if rune(l) == letter {
+			return pieceType, true
+		}
+	}
+	return 0, false
+}
+
+// directions задаёт маркеры направлений в том же круговом порядке, что и
+// смещения соседних клеток в пакете game: восток, юго-восток, юго-запад,
+// запад, северо-запад, северо-восток. Маркер слева от имени фигуры пишется
+// с префиксом, справа — с суффиксом.
+var directions = [6]struct {
+	offset game.Position
+	marker string
+	prefix bool
+}{
+	{game.Position{X: 1, Y: 0}, "-", false},
+	{game.Position{X: 1, Y: 1}, "\\", false},
+	{game.Position{X: 0, Y: 1}, "/", true},
+	{game.Position{X: -1, Y: 0}, "-", true},
+	{game.Position{X: -1, Y: -1}, "\\", true},
+	{game.Position{X: 0, Y: -1}, "/", false},
+}
+
+// Single сообщает, что насекомое входит в набор в одном экземпляре
+// и записывается без порядкового номера.
+func Single(pieceType game.PieceType) bool {
+	switch pieceType {
+	case game.QueenBee, game.Mosquito, game.Ladybug, game.Pillbug:
+		return true
+	}
+	return false
+}
+
+// PieceName возвращает имя фигуры, например "wA1" или "bQ".
+func PieceName(color game.PieceColor, pieceType game.PieceType, number int) string {
+	name := "w"
+	if color == game.Black {
+		name = "b"
+	}
+	name += string(typeLetters[pieceType])
+	if Single(pieceType) {
+		return name
+	}
+	return name + strconv.Itoa(number)
+}
+
+// ParsePieceName разбирает имя фигуры. У насекомых в единственном
+// экземпляре номер можно не указывать.
+func ParsePieceName(name string) (game.PieceColor, game.PieceType, int, error) {
+	if len(name) < 2 {
+		return 0, 0, 0, &ParseError{Token: name, Err: ErrUnknownPiece}
+	}
+
+	var color game.PieceColor
+	switch name[0] {
+	case 'w':
+		color = game.White
+	case 'b':
+		color = game.Black
+	default:
+		return 0, 0, 0, &ParseError{Token: name, Err: ErrUnknownColor}
+	}
+
+	pieceType, ok := pieceTypeOf(rune(name[1]))
+	if !ok {
+		return 0, 0, 0, &ParseError{Token: name, Err: ErrUnknownPiece}
+	}
+
+	if len(name) == 2 {
+		if !Single(pieceType) {
+			return 0, 0, 0, &ParseError{Token: name, Err: ErrBadNumber}
+		}
+		return color, pieceType, 1, nil
+	}
+	number, err := strconv.Atoi(name[2:])
+	if err != nil || number < 1 || Single(pieceType) && number != 1 {
+		return 0, 0, 0, &ParseError{Token: name, Err: ErrBadNumber}
+	}
+	return color, pieceType, number, nil
+}
+
+// FormatMove записывает ход стороны, чья очередь в сессии session.
+// Ход должен быть допустимым в текущей позиции.
+func FormatMove(session *game.GameSession, move *game.Move) (string, error) {
+	if move.Pass {
+		return Pass, nil
+	}
+	if move.Position == nil {
+		return "", game.ErrInvalidMove
+	}
+
+	board := session.GetBoard()
+	name := PieceName(move.Piece.Color, move.Piece.Type, move.Piece.Number)
+	moving := board.Piece(move.Piece)
+	if moving == nil && len(board.Pieces) == 0 {
+		return name, nil
+	}
+
+	if top := board.TopPiece(*move.Position); top != nil && top != moving {
+		return name + " " + PieceName(top.Color, top.Type, top.Number), nil
+	}
+	for _, d := range directions {
+		neighbour := game.Position{X: move.Position.X - d.offset.X, Y: move.Position.Y - d.offset.Y}
+		reference := topExcept(board, neighbour, moving)
+		if reference == nil {
+			continue
+		}
+		referenceName := PieceName(reference.Color, reference.Type, reference.Number)
+		if d.prefix {
+			return name + " " + d.marker + referenceName, nil
+		}
+		return name + " " + referenceName + d.marker, nil
+	}
+	return "", ErrNoReference
+}
+
+// ParseMove разбирает запись хода в позиции сессии session. Допустимость
+// хода по правилам не проверяется: это делает GameSession.ApplyMove.
+func ParseMove(session *game.GameSession, notation string) (*game.Move, error) {
+	fields := strings.Fields(notation)
+	if len(fields) == 1 && strings.EqualFold(fields[0], Pass) {
+		return &game.Move{Pass: true}, nil
+	}
+	if len(fields) == 0 {
+		return nil, &ParseError{Token: notation, Err: ErrUnknownPiece}
+	}
+	if len(fields) > 2 {
+		return nil, &ParseError{Token: fields[2], Err: ErrTooManyTokens}
+	}
+
+	color, pieceType, number, err := ParsePieceName(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	board := session.GetBoard()
+	move := &game.Move{Piece: game.PieceID{Color: color, Type: pieceType, Number: number}}
+	if board.Piece(move.Piece) == nil && number != session.NextNumber(color, pieceType) {
+		return nil, &ParseError{Token: fields[0], Err: ErrBadNumber}
+	}
+
+	if len(fields) == 1 {
+		if len(board.Pieces) != 0 {
+			return nil, &ParseError{Token: notation, Err: ErrNoDestination}
+		}
+		move.Position = &game.Position{}
+		return move, nil
+	}
+
+	reference := fields[1]
+	offset := game.Position{}
+	for _, d := range directions {
+		if d.prefix && strings.HasPrefix(reference, d.marker) {
+			reference, offset = reference[1:], d.offset
+			break
+		}
+		if !d.prefix && strings.HasSuffix(reference, d.marker) {
+			reference, offset = reference[:len(reference)-1], d.offset
+			break
+		}
+	}
+	color, pieceType, number, err = ParsePieceName(reference)
+	if err != nil {
+		return nil, &ParseError{Token: fields[1], Err: errors.Unwrap(err)}
+	}
+	piece := board.Piece(game.PieceID{Color: color, Type: pieceType, Number: number})
+	if piece == nil {
+		return nil, &ParseError{Token: fields[1], Err: ErrNotOnBoard}
+	}
+	move.Position = &game.Position{X: piece.Position.X + offset.X, Y: piece.Position.Y + offset.Y}
+	return move, nil
+}
+
+// topExcept возвращает верхнюю фигуру клетки, не считая фигуры exclude.
+func topExcept(board *game.Board, position game.Position, exclude *game.Piece) *game.Piece {
+	var top *game.Piece
+	for _, piece := range board.Pieces {
+		if piece != exclude && piece.Position == position && (top == nil || piece.Level > top.Level) {
+			top = piece
+		}
+	}
+	return top
+}
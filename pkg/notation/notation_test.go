@@ -0,0 +1,238 @@
+package notation
+
+import (
+	"errors"
+	"hive/pkg/game"
+	"reflect"
+	"testing"
+)
+
+func TestPieceNames(t *testing.T) {
+	for _, color := range []game.PieceColor{game.White, game.Black} {
+		for _, pieceType := range game.PieceTypes {
+			for number := 1; number <= 3; number++ {
+				if Single(pieceType) && number > 1 {
+					break
+				}
+				name := PieceName(color, pieceType, number)
+				c, pt, n, err := ParsePieceName(name)
+				if err != nil || c != color || pt != pieceType || n != number {
+					t.Fatalf("%s разобрано как %v %v %d: %v", name, c, pt, n, err)
+				}
+				if Single(pieceType) != (len(name) == 2) {
+					t.Fatalf("имя %s", name)
+				}
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		err  error
+	}{
+		{"", ErrUnknownPiece},
+		{"w", ErrUnknownPiece},
+		{"xA1", ErrUnknownColor},
+		{"wZ1", ErrUnknownPiece},
+		{"wA", ErrBadNumber},
+		{"wA0", ErrBadNumber},
+		{"wAx", ErrBadNumber},
+		{"wQ2", ErrBadNumber},
+	} {
+		if _, _, _, err := ParsePieceName(c.name); !errors.Is(err, c.err) {
+			t.Errorf("%q: ошибка %v, ожидалась %v", c.name, err, c.err)
+		}
+	}
+}
+
+func place(color game.PieceColor, pieceType game.PieceType, number, x, y int) *game.Move {
+	return &game.Move{Piece: game.PieceID{Color: color, Type: pieceType, Number: number}, Position: &game.Position{X: x, Y: y}}
+}
+
+// play применяет ходы к новой партии по стандартным правилам.
+func play(t *testing.T, moves ...*game.Move) *game.GameSession {
+	t.Helper()
+	session := game.NewGameSession(game.StandardHand)
+	for _, move := range moves {
+		if err := session.ApplyMove(move); err != nil {
+			t.Fatalf("ход %+v: %v", *move, err)
+		}
+	}
+	return session
+}
+
+// roundTrip проверяет, что ход записывается строкой want и разбирается обратно.
+func roundTrip(t *testing.T, session *game.GameSession, move *game.Move, want string) {
+	t.Helper()
+	formatted, err := FormatMove(session, move)
+	if err != nil || formatted != want {
+		t.Fatalf("ход %+v записан как %q (%v), ожидалось %q", *move, formatted, err, want)
+	}
+	parsed, err := ParseMove(session, formatted)
+	if err != nil {
+		t.Fatalf("%q: %v", formatted, err)
+	}
+	if parsed.Pass != move.Pass || parsed.Piece != move.Piece || !reflect.DeepEqual(parsed.Position, move.Position) {
+		t.Fatalf("%q разобран как %+v, ожидался %+v", formatted, *parsed, *move)
+	}
+}
+
+func TestDirections(t *testing.T) {
+	queen := place(game.White, game.QueenBee, 1, 0, 0)
+	for _, c := range []struct {
+		x, y int
+		want string
+	}{
+		{1, 0, "bQ wQ-"},
+		{1, 1, `bQ wQ\`},
+		{0, 1, "bQ /wQ"},
+		{-1, 0, "bQ -wQ"},
+		{-1, -1, `bQ \wQ`},
+		{0, -1, "bQ wQ/"},
+	} {
+		roundTrip(t, play(t, queen), place(game.Black, game.QueenBee, 1, c.x, c.y), c.want)
+	}
+}
+
+func TestFirstMoveAndPass(t *testing.T) {
+	session := play(t)
+	roundTrip(t, session, place(game.White, game.SoldierAnt, 1, 0, 0), "wA1")
+	roundTrip(t, session, &game.Move{Pass: true}, Pass)
+	if move, err := ParseMove(session, "PASS"); err != nil || !move.Pass {
+		t.Fatalf("PASS разобран как %+v: %v", move, err)
+	}
+}
+
+func TestBeetleOnTop(t *testing.T) {
+	session := play(t,
+		place(game.White, game.QueenBee, 1, 0, 0),
+		place(game.Black, game.QueenBee, 1, 1, 0),
+		place(game.White, game.Beetle, 1, -1, 0),
+		place(game.Black, game.Beetle, 1, 2, 0),
+	)
+	climb := place(game.White, game.Beetle, 1, 0, 0)
+	roundTrip(t, session, climb, "wB1 wQ")
+	if err := session.ApplyMove(climb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.ApplyMove(place(game.Black, game.Spider, 1, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Соседняя клетка записывается относительно жука на вершине стопки
+	ant := place(game.White, game.SoldierAnt, 1, -1, 0)
+	roundTrip(t, session, ant, "wA1 -wB1")
+	if err := session.ApplyMove(ant); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.ApplyMove(place(game.Black, game.Spider, 2, 4, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Спускаясь, жук не может служить ориентиром сам себе
+	roundTrip(t, session, place(game.White, game.Beetle, 1, -1, -1), `wB1 \wQ`)
+}
+
+func TestParseMoveErrors(t *testing.T) {
+	session := play(t, place(game.White, game.QueenBee, 1, 0, 0))
+	for _, c := range []struct {
+		notation string
+		err      error
+	}{
+		{"", ErrUnknownPiece},
+		{"bQ", ErrNoDestination},
+		{"bQ wQ- wQ", ErrTooManyTokens},
+		{"bQ -wS1", ErrNotOnBoard},
+		{"bQ -wZ", ErrUnknownPiece},
+		{"bQ -x", ErrUnknownPiece},
+		{"bA2 -wQ", ErrBadNumber},
+		{"yA1 -wQ", ErrUnknownColor},
+	} {
+		_, err := ParseMove(session, c.notation)
+		var parseErr *ParseError
+		if !errors.Is(err, c.err) || !errors.As(err, &parseErr) {
+			t.Errorf("%q: ошибка %v, ожидалась %v", c.notation, err, c.err)
+		}
+	}
+
+	if _, err := FormatMove(session, &game.Move{Piece: game.PieceID{Color: game.Black, Type: game.QueenBee, Number: 1}}); err != game.ErrInvalidMove {
+		t.Errorf("ход без клетки: %v", err)
+	}
+	if _, err := FormatMove(session, place(game.Black, game.QueenBee, 1, 5, 5)); err != ErrNoReference {
+		t.Errorf("ход без соседей: %v", err)
+	}
+}
+
+func TestGameType(t *testing.T) {
+	for _, c := range []struct {
+		gameType   string
+		expansions string
+	}{
+		{"Base", ""},
+		{"Base+M", "M"},
+		{"Base+MLP", "MLP"},
+	} {
+		expansions, err := ParseGameType(c.gameType)
+		if err != nil || expansions != c.expansions {
+			t.Errorf("%q: расширения %q (%v), ожидались %q", c.gameType, expansions, err, c.expansions)
+		}
+	}
+	for _, gameType := range []string{"", "Extended", "BaseM", "Base+", "Base+X", "base+M"} {
+		if _, err := ParseGameType(gameType); err == nil {
+			t.Errorf("%q принят", gameType)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	for _, c := range []struct {
+		rules game.Rules
+		text  string
+	}{
+		{game.Rules{}, "Base"},
+		{game.Rules{Expansions: "PLM"}, "Base+MLP"},
+		{game.Rules{Expansions: "M", Tournament: true}, "Base+M,tournament"},
+		{game.Rules{QueenDeadline: 3, Openings: []game.PieceType{game.Spider, game.Grasshopper}}, "Base,queen=3,openings=SG"},
+	} {
+		if text := FormatRules(c.rules); text != c.text {
+			t.Errorf("%+v записаны как %q, ожидалось %q", c.rules, text, c.text)
+		}
+		rules, err := ParseRules(c.text)
+		if err != nil || FormatRules(rules) != c.text {
+			t.Errorf("%q разобраны как %+v: %v", c.text, rules, err)
+		}
+	}
+	for _, text := range []string{"Base,queen=0", "Base,queen=x", "Base,openings=Z", "Base,unknown", "Base+X,tournament"} {
+		if _, err := ParseRules(text); err == nil {
+			t.Errorf("%q приняты", text)
+		}
+	}
+}
+
+func TestGameString(t *testing.T) {
+	gameString := `Base+M;InProgress;White[3];wS1;bG1 -wS1;wQ wS1\;bM -bG1`
+	session, moves, err := ParseGameString(gameString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 4 || session.GetTurn() != 4 {
+		t.Fatalf("ходы %q, ход партии %d", moves, session.GetTurn())
+	}
+	if text := GameString("Base+M", session, moves); text != gameString {
+		t.Fatalf("партия записана как %q", text)
+	}
+	if text := GameString("Base", play(t), nil); text != "Base;NotStarted;White[1]" {
+		t.Fatalf("новая партия записана как %q", text)
+	}
+
+	for _, bad := range []string{
+		"Base;InProgress",
+		"Base;InProgress;White[2];wS1;bQ wS1",
+		"Base;InProgress;White[2];wS1;bS1 -wS2",
+		"Base;InProgress;White[1];bS1",
+	} {
+		if _, _, err := ParseGameString(bad); err == nil {
+			t.Errorf("%q принята", bad)
+		}
+	}
+}
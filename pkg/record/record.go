@@ -0,0 +1,258 @@
+// Package record хранит запись партии: сведения об игроках и варианте игры,
+// время начала, результат и ходы в стандартной нотации. Запись сохраняется
+// в текстовом формате, похожем на PGN, или в JSON через encoding/json.
+//
+// Пример текстовой записи:
+//
+//	[GameID "3f2a..."]
+//	[White "9c1e..."]
+//	[Black "a07b..."]
+//	[GameType "Base+MLP"]
+//	[Started "2024-05-01T12:00:00Z"]
+//	[Result "WhiteWins"]
+//
+//	1. wS1
+//	2. bG1 -wS1
+//
+// Тег Termination пишется, только если партия завершилась не по позиции
+// на доске, например "time forfeit" при падении флажка.
+package record
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hive/pkg/game"
+	"hive/pkg/notation"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadHeader   = errors.New("некорректный заголовок записи")
+	ErrBadMove     = errors.New("некорректная строка хода")
+	ErrResultMatch = errors.New("результат записи не совпадает с позицией на доске")
+)
+
+// Record — запись партии. GameType содержит вариант правил в записи
+// notation.FormatRules; для стандартных правил это строка типа игры UHP.
+type Record struct {
+	GameID   game.ID
+	White    game.ID
+	Black    game.ID
+	GameType string
+	Started  time.Time
+	Result   game.GameResult
+	Moves    []string
+
+	// Termination — причина завершения партии не по позиции на доске.
+	Termination string
+}
+
+// Значения тега Termination. Причины поражения за нарушение правил,
+// по времени и за уход из партии записываются, как в PGN.
+const (
+	TerminationRulesInfraction = "rules infraction"
+	TerminationTimeForfeit     = "time forfeit"
+	TerminationAbandoned       = "abandoned"
+	TerminationResignation     = "resignation"
+	TerminationAgreement       = "agreement"
+)
+
+// New начинает запись партии, которая играется по правилам rules.
+func New(id, white, black game.ID, rules game.Rules, started time.Time) *Record {
+	return &Record{
+		GameID:   id,
+		White:    white,
+		Black:    black,
+		GameType: notation.FormatRules(rules),
+		Started:  started,
+	}
+}
+
+// Play проверяет ход, применяет его к сессии и дописывает в запись.
+// Сессия должна соответствовать уже записанным ходам.
+func (r *Record) Play(session *game.GameSession, move *game.Move) error {
+	if err := session.ValidateMove(move); err != nil {
+		return err
+	}
+	played, err := notation.FormatMove(session, move)
+	if err != nil {
+		return err
+	}
+	if err = session.ApplyMove(move); err != nil {
+		return err
+	}
+	r.Moves = append(r.Moves, played)
+	r.Result = session.Result()
+	return nil
+}
+
+// Undo отменяет последний ход в сессии и убирает его из записи.
+func (r *Record) Undo(session *game.GameSession) error {
+	if err := session.Undo(); err != nil {
+		return err
+	}
+	r.Moves = r.Moves[:len(r.Moves)-1]
+	r.Result = session.Result()
+	return nil
+}
+
+// Forfeit записывает поражение игрока color по причине termination.
+func (r *Record) Forfeit(session *game.GameSession, color game.PieceColor, termination string) {
+	session.Forfeit(color)
+	r.Result = session.Result()
+	r.Termination = termination
+}
+
+// AgreeDraw записывает ничью по соглашению игроков.
+func (r *Record) AgreeDraw(session *game.GameSession) {
+	session.AgreeDraw()
+	r.Result = session.Result()
+	r.Termination = TerminationAgreement
+}
+
+// LoadGame восстанавливает партию, переигрывая записанные ходы по правилам.
+// Запись с недопустимым ходом или с результатом, не совпадающим с позицией,
+// отвергается.
+func LoadGame(r *Record) (*game.GameSession, error) {
+	rules, err := notation.ParseRules(r.GameType)
+	if err != nil {
+		return nil, err
+	}
+	session, err := game.NewGameSessionWithRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, move := range r.Moves {
+		parsed, err := notation.ParseMove(session, move)
+		if err != nil {
+			return nil, fmt.Errorf("ход %d: %w", i+1, err)
+		}
+		if err = session.ApplyMove(parsed); err != nil {
+			return nil, fmt.Errorf("ход %d %q: %w", i+1, move, err)
+		}
+	}
+	if r.Termination != "" && session.Result() == game.InProgress {
+		switch r.Result {
+		case game.WhiteWon:
+			session.Forfeit(game.Black)
+		case game.BlackWon:
+			session.Forfeit(game.White)
+		case game.Draw:
+			session.AgreeDraw()
+		}
+	}
+	if session.Result() != r.Result {
+		return nil, ErrResultMatch
+	}
+	return session, nil
+}
+
+// Encode записывает партию в текстовом формате.
+func (r *Record) Encode(w io.Writer) error {
+	result, err := r.Result.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	tags := [][2]string{
+		{"GameID", r.GameID.String()},
+		{"White", r.White.String()},
+		{"Black", r.Black.String()},
+		{"GameType", r.GameType},
+		{"Started", r.Started.UTC().Format(time.RFC3339)},
+		{"Result", string(result)},
+	}
+	if r.Termination != "" {
+		tags = append(tags, [2]string{"Termination", r.Termination})
+	}
+	for _, tag := range tags {
+		fmt.Fprintf(&b, "[%s %q]\n", tag[0], tag[1])
+	}
+	b.WriteString("\n")
+	for i, move := range r.Moves {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, move)
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// Decode читает партию в текстовом формате. Ходы не проверяются:
+// для этого используется LoadGame.
+func Decode(rd io.Reader) (*Record, error) {
+	r := &Record{}
+	scanner := bufio.NewScanner(rd)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if len(r.Moves) > 0 {
+				return nil, fmt.Errorf("строка %d: %w", line, ErrBadHeader)
+			}
+			if err := r.decodeTag(text); err != nil {
+				return nil, fmt.Errorf("строка %d: %w", line, err)
+			}
+			continue
+		}
+
+		number, move, ok := strings.Cut(text, ".")
+		if n, err := strconv.Atoi(number); !ok || err != nil || n != len(r.Moves)+1 {
+			return nil, fmt.Errorf("строка %d: %w", line, ErrBadMove)
+		}
+		r.Moves = append(r.Moves, strings.TrimSpace(move))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if r.GameType == "" {
+		return nil, fmt.Errorf("не указан тип игры: %w", ErrBadHeader)
+	}
+	return r, nil
+}
+
+func (r *Record) decodeTag(text string) error {
+	if !strings.HasSuffix(text, "]") {
+		return ErrBadHeader
+	}
+	name, quoted, ok := strings.Cut(text[1:len(text)-1], " ")
+	if !ok {
+		return ErrBadHeader
+	}
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return ErrBadHeader
+	}
+
+	switch name {
+	case "GameID":
+		err = r.GameID.UnmarshalText([]byte(value))
+	case "White":
+		err = r.White.UnmarshalText([]byte(value))
+	case "Black":
+		err = r.Black.UnmarshalText([]byte(value))
+	case "GameType":
+		r.GameType = value
+	case "Started":
+		r.Started, err = time.Parse(time.RFC3339, value)
+	case "Result":
+		err = r.Result.UnmarshalText([]byte(value))
+	case "Termination":
+		r.Termination = value
+	default:
+		// Незнакомые теги пропускаются, как в PGN
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
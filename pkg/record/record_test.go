@@ -0,0 +1,163 @@
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hive/pkg/game"
+	"hive/pkg/notation"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var started = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// played записывает партию из ходов moves в нотации по правилам rules.
+func played(t *testing.T, rules game.Rules, moves ...string) (*Record, *game.GameSession) {
+	t.Helper()
+	session, err := game.NewGameSessionWithRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(game.NewID(), game.NewID(), game.NewID(), rules, started)
+	for _, text := range moves {
+		move, err := notation.ParseMove(session, text)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if err = r.Play(session, move); err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+	}
+	return r, session
+}
+
+func TestEncodeDecode(t *testing.T) {
+	r, session := played(t, game.Rules{Expansions: "M", Tournament: true}, "wS1", "bG1 -wS1", `wQ wS1\`, "bM -bG1")
+	r.Forfeit(session, game.Black, TerminationTimeForfeit)
+
+	var text bytes.Buffer
+	if err := r.Encode(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), `[GameType "Base+M,tournament"]`) || !strings.Contains(text.String(), "4. bM -bG1\n") {
+		t.Fatalf("запись:\n%s", text.String())
+	}
+	decoded, err := Decode(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Fatalf("прочитано %+v, записано %+v", decoded, r)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &Record{}
+	if err = json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, r) {
+		t.Fatalf("из JSON прочитано %+v, записано %+v", fromJSON, r)
+	}
+
+	loaded, err := LoadGame(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Hash() != session.Hash() || loaded.Result() != game.WhiteWon || len(loaded.History()) != 4 {
+		t.Fatalf("восстановлена партия с результатом %v и %d ходами", loaded.Result(), len(loaded.History()))
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	header := "[GameType \"Base\"]\n"
+	for _, c := range []struct {
+		name string
+		text string
+		err  error
+	}{
+		{"без типа игры", "1. wS1\n", ErrBadHeader},
+		{"тег после ходов", header + "1. wS1\n[Result \"Draw\"]\n", ErrBadHeader},
+		{"тег без кавычек", "[GameType Base]\n", ErrBadHeader},
+		{"незакрытый тег", "[GameType \"Base\"\n", ErrBadHeader},
+		{"пропущен номер", header + "1. wS1\n3. bS1 -wS1\n", ErrBadMove},
+		{"ход без номера", header + "wS1\n", ErrBadMove},
+		{"неизвестный результат", "[Result \"Unknown\"]\n" + header, nil},
+		{"некорректное время", "[Started \"вчера\"]\n" + header, nil},
+	} {
+		_, err := Decode(strings.NewReader(c.text))
+		if err == nil || c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: ошибка %v, ожидалась %v", c.name, err, c.err)
+		}
+	}
+
+	// Незнакомые теги пропускаются
+	r, err := Decode(strings.NewReader("[Event \"Турнир\"]\n" + header + "\n1. wS1\n"))
+	if err != nil || r.GameType != "Base" || len(r.Moves) != 1 {
+		t.Fatalf("прочитано %+v: %v", r, err)
+	}
+}
+
+func TestLoadGameErrors(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		gameType string
+		moves    []string
+		result   game.GameResult
+	}{
+		{"неизвестный тип игры", "Base+X", nil, game.InProgress},
+		{"неразборчивый ход", "Base", []string{"wS1", "zz"}, game.InProgress},
+		{"недопустимый ход", "Base", []string{"wS1", "bQ wS1"}, game.InProgress},
+		{"насекомое не из набора", "Base", []string{"wM"}, game.InProgress},
+		{"турнирное правило", "Base,tournament", []string{"wQ"}, game.InProgress},
+		{"результат без причины", "Base", []string{"wS1", "bS1 -wS1"}, game.WhiteWon},
+	} {
+		r := &Record{GameType: c.gameType, Moves: c.moves, Result: c.result}
+		if _, err := LoadGame(r); err == nil {
+			t.Errorf("%s: запись принята", c.name)
+		}
+	}
+
+	r, _ := played(t, game.Rules{}, "wS1", "bS1 -wS1")
+	r.Result = game.Draw
+	if _, err := LoadGame(r); err != ErrResultMatch {
+		t.Fatalf("ничья без причины: %v", err)
+	}
+	r.Termination = TerminationAgreement
+	if _, err := LoadGame(r); err != nil {
+		t.Fatalf("ничья по соглашению: %v", err)
+	}
+}
+
+func TestPlayUndo(t *testing.T) {
+	r, session := played(t, game.Rules{}, "wS1", "bS1 -wS1")
+
+	// Недопустимый ход не попадает в запись
+	illegal := &game.Move{Piece: game.PieceID{Color: game.Black, Type: game.QueenBee, Number: 1}, Position: &game.Position{X: 1, Y: 0}}
+	if err := r.Play(session, illegal); err == nil {
+		t.Fatal("принят ход не в свою очередь")
+	}
+	if len(r.Moves) != 2 || session.GetTurn() != 2 {
+		t.Fatalf("после отклонённого хода записано %q", r.Moves)
+	}
+
+	if err := r.Undo(session); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Moves, []string{"wS1"}) || session.GetTurn() != 1 {
+		t.Fatalf("после отмены записано %q", r.Moves)
+	}
+
+	r.AgreeDraw(session)
+	if r.Result != game.Draw || r.Termination != TerminationAgreement {
+		t.Fatalf("ничья записана как %v, %q", r.Result, r.Termination)
+	}
+	if _, err := LoadGame(r); err != nil {
+		t.Fatal(err)
+	}
+}
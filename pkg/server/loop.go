@@ -0,0 +1,374 @@
+package server
+
+import (
+	"errors"
+	"hive/pkg/api"
+	"hive/pkg/game"
+	"hive/pkg/record"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// gameLoop — состояние партии, которую ведёт StartGame. Игроки
+// нумеруются по порядку в партии: первый играет белыми.
+type gameLoop struct {
+	game    *api.Game
+	players []*api.Player
+	// su — состояние для игрока, чья очередь; send — его нужно отправить
+	su   *api.StatusUpdate
+	send bool
+	// announced — правила партии сообщены игроку в первом обновлении
+	announced [2]bool
+	// illegal — число недопустимых ходов игрока подряд
+	illegal [2]int
+	// drawOffered — игрок предложил ничью, и соперник ещё не ответил
+	drawOffered [2]bool
+	// takeback — игрок, чья очередь, ждёт ответа на запрос отмены хода
+	takeback bool
+	// reason — причина завершения партии не на доске
+	reason  string
+	aborted bool
+	// offline — до какого момента партия ждёт возвращения игрока,
+	// соединение с которым потеряно; нулевое значение — игрок на связи
+	offline [2]time.Time
+}
+
+func (l *gameLoop) over() bool {
+	return l.aborted || l.game.Session.IsGameOver()
+}
+
+// graceDeadline возвращает ближайший момент, когда истечёт ожидание
+// отключившегося игрока, или нулевое значение.
+func (l *gameLoop) graceDeadline() time.Time {
+	var deadline time.Time
+	for _, offline := range l.offline {
+		if !offline.IsZero() && (deadline.IsZero() || offline.Before(deadline)) {
+			deadline = offline
+		}
+	}
+	return deadline
+}
+
+// timerAt возвращает канал, срабатывающий в момент deadline, и функцию
+// остановки таймера. Для нулевого момента канал равен nil.
+func timerAt(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop
+}
+
+func colorOf(player int) game.PieceColor {
+	if player == 1 {
+		return game.Black
+	}
+	return game.White
+}
+
+// playerMessage — сообщение игрока с номером player, ошибка чтения или
+// известие о том, что игрок подключился заново.
+type playerMessage struct {
+	player      int
+	move        *api.PlayMove
+	err         error
+	reconnected bool
+}
+
+// readMessages передаёт ходы игрока в этой партии в messages, пока партия
+// не закончится. Ходы в других партиях того же игрока сюда не попадают.
+// После потери соединения чтение продолжается, когда игрок вернётся.
+func (s *Server) readMessages(player *api.Player, gameID game.ID, index int, messages chan<- playerMessage, done <-chan struct{}) {
+	for {
+		m := playerMessage{player: index}
+		m.move, m.err = s.api.ReceiveMove(player, gameID)
+		if errors.Is(m.err, api.ErrDisconnected) {
+			select {
+			case messages <- m:
+			case <-done:
+				return
+			}
+			m = playerMessage{player: index, reconnected: true}
+			m.err = s.api.AwaitReconnect(player, gameID)
+		}
+		if m.err != nil {
+			return
+		}
+		select {
+		case messages <- m:
+		case <-done:
+			return
+		}
+	}
+}
+
+// sendTurn отправляет состояние партии игроку, чья очередь, и запускает его
+// часы. Отключившийся игрок получит состояние, когда вернётся, но его часы
+// идут и без связи.
+func (s *Server) sendTurn(l *gameLoop) error {
+	g := l.game
+	turn := g.Session.GetTurn() % 2
+	// Часы идут, пока игрок думает, в том числе над повторной попыткой
+	// после отклонённого хода и в ожидании ответа на запрос отмены хода
+	if g.Clock != nil && !g.Clock.Running() {
+		g.Clock.Start(g.Session.ColorToMove(), time.Now())
+	}
+	if !l.offline[turn].IsZero() {
+		return nil
+	}
+	if !l.announced[turn] {
+		rules := g.Session.Rules()
+		l.su.Rules = &rules
+		l.announced[turn] = true
+	}
+	if g.Clock != nil {
+		l.su.GameState.Clocks = clocks(g, g.Session.ColorToMove())
+	}
+	l.send = false
+	return s.api.SendStatusUpdate(l.players[turn], l.su)
+}
+
+func (s *Server) flagFall(l *gameLoop) {
+	g := l.game
+	s.log.Info("Поражение по времени", zap.Any("id", g.ID), zap.Any("player", l.players[g.Session.GetTurn()%2].ID))
+	g.Record.Forfeit(g.Session, g.Session.ColorToMove(), record.TerminationTimeForfeit)
+	l.reason = api.ReasonTimeout
+}
+
+// playerLost начинает ждать возвращения игрока, соединение с которым
+// потеряно. Без отсрочки на переподключение поражение засчитывается сразу.
+func (s *Server) playerLost(l *gameLoop, m playerMessage) {
+	if s.reconnectGrace <= 0 {
+		s.disconnect(l, m)
+		return
+	}
+	if !l.offline[m.player].IsZero() {
+		return
+	}
+	s.log.Info("Ожидание переподключения игрока", zap.Any("id", l.game.ID), zap.Any("player", l.players[m.player].ID), zap.Error(m.err))
+	l.offline[m.player] = time.Now().Add(s.reconnectGrace)
+}
+
+// graceExpired засчитывает поражение игроку, не вернувшемуся вовремя.
+func (s *Server) graceExpired(l *gameLoop) {
+	now := time.Now()
+	for i, offline := range l.offline {
+		if !offline.IsZero() && !now.Before(offline) {
+			s.disconnect(l, playerMessage{player: i, err: api.ErrDisconnected})
+			return
+		}
+	}
+}
+
+// resume возвращает в партию переподключившегося игрока: он заново получает
+// состояние партии, если сейчас его очередь, и предложения соперника, на
+// которые ещё не ответил.
+func (s *Server) resume(l *gameLoop, player int) error {
+	g := l.game
+	s.log.Info("Игрок вернулся в партию", zap.Any("id", g.ID), zap.Any("player", l.players[player].ID))
+	l.offline[player] = time.Time{}
+	// Первое состояние с правилами партии могло не дойти до игрока
+	l.announced[player] = false
+	if l.drawOffered[1-player] {
+		err := s.api.SendStatusUpdate(l.players[player], &api.StatusUpdate{GameID: g.ID, DrawOffer: &api.DrawOffer{}})
+		if err != nil {
+			return err
+		}
+	}
+	if player == g.Session.GetTurn()%2 {
+		// Запросивший отмену хода получит состояние вместе с ответом соперника
+		l.send = !l.takeback
+		return nil
+	}
+	if l.takeback {
+		return s.offerTakeback(l)
+	}
+	return nil
+}
+
+// disconnect засчитывает поражение игроку, соединение с которым потеряно.
+func (s *Server) disconnect(l *gameLoop, m playerMessage) {
+	g := l.game
+	s.log.Info("Игрок отключился", zap.Any("id", g.ID), zap.Any("player", l.players[m.player].ID), zap.Error(m.err))
+	g.Record.Forfeit(g.Session, colorOf(m.player), record.TerminationAbandoned)
+	l.reason = api.ReasonDisconnect
+}
+
+// handleMessage обрабатывает сообщение игрока. Ходы принимаются только от
+// игрока, чья очередь; сдаться, предложить ничью и ответить на предложение
+// можно в любой момент.
+func (s *Server) handleMessage(l *gameLoop, m playerMessage) error {
+	g := l.game
+	turn := g.Session.GetTurn() % 2
+	move := m.move
+
+	var err error
+	switch {
+	case move.Resign != nil:
+		s.log.Info("Игрок сдался", zap.Any("id", g.ID), zap.Any("player", l.players[m.player].ID))
+		g.Record.Forfeit(g.Session, colorOf(m.player), record.TerminationResignation)
+		l.reason = api.ReasonResignation
+	case move.Abort != nil:
+		err = s.abort(l, m.player)
+	case move.DrawOffer != nil:
+		err = s.offerDraw(l, m.player)
+	case move.DrawReply != nil:
+		err = s.replyDraw(l, m.player, move.DrawReply.Accepted)
+	case move.Takeback != nil && m.player != turn:
+		return s.rejectTakeback(l, m.player)
+	case move.TakebackReply != nil:
+		if !l.takeback || m.player == turn {
+			s.log.Info("Ответ на отсутствующий запрос отмены хода", zap.Any("player", l.players[m.player].ID))
+			return nil
+		}
+		l.takeback = false
+		l.su, err = s.Takeback(g, move.TakebackReply.Accepted)
+		l.send = true
+		return err
+	case m.player != turn:
+		// Очередь могла перейти, пока ход был в пути; попытка не считается недопустимой
+		return s.api.SendMoveRejected(l.players[m.player], s.MoveRejected(g, move, game.ErrNotYourTurn, l.illegal[m.player]))
+	case move.Takeback != nil:
+		return s.requestTakeback(l)
+	default:
+		return s.playMove(l, move)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Клиент игрока, чья очередь, прерывает ожидание хода ради действия
+	// и ждёт состояние партии повторно
+	if m.player == turn && !l.over() {
+		l.send = true
+	}
+	return nil
+}
+
+func (s *Server) playMove(l *gameLoop, move *api.PlayMove) error {
+	g := l.game
+	turn := g.Session.GetTurn() % 2
+	player := l.players[turn]
+	if g.Clock != nil && g.Clock.Remaining(g.Session.ColorToMove(), time.Now()) == 0 {
+		s.flagFall(l)
+		return nil
+	}
+
+	next, err := s.UpdateGameState(g, move.Move)
+	if err != nil {
+		// Ход не применён, очередь не переходит: игрок получит то же состояние повторно
+		s.log.Info("Недопустимый ход", zap.Any("player", player.ID), zap.Error(err),
+			zap.Stringer("position", g.Session.State()))
+		l.illegal[turn] += 1
+		if s.maxIllegalMoves > 0 && l.illegal[turn] >= s.maxIllegalMoves {
+			s.log.Info("Поражение за недопустимые ходы", zap.Any("id", g.ID), zap.Any("player", player.ID))
+			g.Record.Forfeit(g.Session, g.Session.ColorToMove(), record.TerminationRulesInfraction)
+			l.reason = api.ReasonRulesInfraction
+			return nil
+		}
+		l.send = true
+		return s.api.SendMoveRejected(player, s.MoveRejected(g, move, err, l.illegal[turn]))
+	}
+
+	// Ход отменяет запрос отмены хода и отклоняет предложение ничьей соперника
+	l.illegal[turn] = 0
+	l.takeback = false
+	l.drawOffered[1-turn] = false
+	l.su = next
+	l.send = true
+	return nil
+}
+
+// requestTakeback передаёт сопернику запрос игрока, чья сейчас очередь, на
+// отмену его последнего хода. Соперник, не поддерживающий отмену ходов,
+// отказывает без запроса.
+func (s *Server) requestTakeback(l *gameLoop) error {
+	g := l.game
+	turn := g.Session.GetTurn() % 2
+	if len(g.Session.History()) < 2 {
+		l.send = true
+		return s.rejectTakeback(l, turn)
+	}
+	if !l.players[1-turn].Supports(api.CapabilityTakeback) {
+		su, err := s.Takeback(g, false)
+		l.su = su
+		l.send = true
+		return err
+	}
+
+	l.takeback = true
+	return s.offerTakeback(l)
+}
+
+// rejectTakeback отклоняет запрос отмены хода: отменяются всегда два
+// полухода, поэтому запросить отмену можно только в свою очередь после
+// ответа соперника.
+func (s *Server) rejectTakeback(l *gameLoop, player int) error {
+	return s.api.SendMoveRejected(l.players[player], &api.MoveRejected{
+		GameID:       l.game.ID,
+		Code:         api.RejectTakebackNotAllowed,
+		Message:      "отменить можно только свой ход, на который соперник уже ответил, и только в свою очередь",
+		AttemptsLeft: -1,
+	})
+}
+
+func (s *Server) offerTakeback(l *gameLoop) error {
+	g := l.game
+	return s.api.SendStatusUpdate(l.players[(g.Session.GetTurn()+1)%2], &api.StatusUpdate{
+		GameID:        g.ID,
+		GameState:     gameState(g, g.Session.ColorToMove().Opponent()),
+		TakebackOffer: &api.TakebackRequest{},
+	})
+}
+
+// abort прерывает партию, если игрок ещё не сделал свой первый ход.
+func (s *Server) abort(l *gameLoop, player int) error {
+	g := l.game
+	if g.Session.GetTurn() > player {
+		return s.api.SendMoveRejected(l.players[player], &api.MoveRejected{
+			GameID:       g.ID,
+			Code:         api.RejectAbortNotAllowed,
+			Message:      "прервать партию можно только до своего первого хода",
+			AttemptsLeft: -1,
+		})
+	}
+	s.log.Info("Партия прервана", zap.Any("id", g.ID), zap.Any("player", l.players[player].ID))
+	l.aborted = true
+	l.reason = api.ReasonAborted
+	return nil
+}
+
+// offerDraw передаёт сопернику предложение ничьей. Встречное предложение
+// означает согласие.
+func (s *Server) offerDraw(l *gameLoop, player int) error {
+	g := l.game
+	if l.drawOffered[1-player] {
+		return s.replyDraw(l, player, true)
+	}
+	if l.drawOffered[player] {
+		return nil
+	}
+	s.log.Info("Предложена ничья", zap.Any("id", g.ID), zap.Any("player", l.players[player].ID))
+	l.drawOffered[player] = true
+	return s.api.SendStatusUpdate(l.players[1-player], &api.StatusUpdate{GameID: g.ID, DrawOffer: &api.DrawOffer{}})
+}
+
+// replyDraw применяет ответ игрока на предложение ничьей соперника.
+// Об отказе соперник получает уведомление.
+func (s *Server) replyDraw(l *gameLoop, player int, accepted bool) error {
+	g := l.game
+	if !l.drawOffered[1-player] {
+		s.log.Info("Ответ на отсутствующее предложение ничьей", zap.Any("player", l.players[player].ID))
+		return nil
+	}
+	l.drawOffered[1-player] = false
+
+	s.log.Info("Ответ на предложение ничьей", zap.Any("id", g.ID), zap.Bool("accepted", accepted))
+	if accepted {
+		g.Record.AgreeDraw(g.Session)
+		l.reason = api.ReasonAgreement
+		return nil
+	}
+	return s.api.SendStatusUpdate(l.players[1-player], &api.StatusUpdate{GameID: g.ID, DrawReply: &api.DrawReply{}})
+}
@@ -0,0 +1,518 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hive/pkg/api"
+	"hive/pkg/game"
+	"hive/pkg/record"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sent — сообщение, отправленное игроку сервером.
+type sent struct {
+	player   *api.Player
+	su       *api.StatusUpdate
+	rejected *api.MoveRejected
+}
+
+// fakeTransport связывает сервер с игроками через каналы: ходы игроков
+// кладутся в inboxes, nil в очереди означает потерю соединения, а
+// возвращение игрока — сигнал в reconnects. Отправленные сообщения
+// попадают в sent.
+type fakeTransport struct {
+	players    map[game.ID]*api.Player
+	inboxes    map[*api.Player]chan *api.PlayMove
+	reconnects map[*api.Player]chan struct{}
+	sent       chan sent
+	closed     chan struct{}
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		players:    map[game.ID]*api.Player{},
+		inboxes:    map[*api.Player]chan *api.PlayMove{},
+		reconnects: map[*api.Player]chan struct{}{},
+		sent:       make(chan sent, 64),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (f *fakeTransport) Start(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeTransport) GetPlayer(id game.ID) (*api.Player, error) {
+	player, ok := f.players[id]
+	if !ok {
+		return nil, fmt.Errorf("player ID not found: %v", id)
+	}
+	return player, nil
+}
+
+func (f *fakeTransport) ReceiveMove(player *api.Player, gameID game.ID) (*api.PlayMove, error) {
+	select {
+	case move := <-f.inboxes[player]:
+		if move == nil {
+			return nil, api.ErrDisconnected
+		}
+		return move, nil
+	case <-f.closed:
+		return nil, api.ErrGameRemoved
+	}
+}
+
+func (f *fakeTransport) AwaitReconnect(player *api.Player, gameID game.ID) error {
+	select {
+	case <-f.reconnects[player]:
+		return nil
+	case <-f.closed:
+		return api.ErrGameRemoved
+	}
+}
+
+func (f *fakeTransport) SendStatusUpdate(player *api.Player, su *api.StatusUpdate) error {
+	f.sent <- sent{player: player, su: su}
+	return nil
+}
+
+func (f *fakeTransport) SendMoveRejected(player *api.Player, rejected *api.MoveRejected) error {
+	f.sent <- sent{player: player, rejected: rejected}
+	return nil
+}
+
+// harness ведёт партию сервера через fakeTransport. Игрок 0 играет белыми.
+type harness struct {
+	t       *testing.T
+	s       *Server
+	fake    *fakeTransport
+	g       *api.Game
+	players [2]*api.Player
+	done    chan error
+	cancel  context.CancelFunc
+}
+
+// startGame запускает партию сервера, настроенного configure.
+func startGame(t *testing.T, configure func(*Server)) *harness {
+	t.Helper()
+	fake := newFakeTransport()
+	s := NewServer(zap.NewNop(), "")
+	s.api = fake
+	configure(s)
+
+	g, err := s.CreateNewGame(&api.Player{ID: game.NewID()}, &api.Player{ID: game.NewID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{t: t, s: s, fake: fake, g: g, done: make(chan error, 1)}
+	for i, id := range g.Players {
+		h.players[i] = &api.Player{ID: id}
+		fake.players[id] = h.players[i]
+		fake.inboxes[h.players[i]] = make(chan *api.PlayMove, 8)
+		fake.reconnects[h.players[i]] = make(chan struct{})
+	}
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(context.Background())
+	go func() {
+		h.done <- s.StartGame(ctx, g)
+	}()
+	t.Cleanup(func() {
+		h.cancel()
+		close(fake.closed)
+	})
+	return h
+}
+
+// send передаёт серверу сообщение игрока player.
+func (h *harness) send(player int, move *api.PlayMove) {
+	move.GameID = h.g.ID
+	h.fake.inboxes[h.players[player]] <- move
+}
+
+// drop обрывает соединение с игроком player.
+func (h *harness) drop(player int) {
+	h.fake.inboxes[h.players[player]] <- nil
+}
+
+// reconnect возвращает в партию игрока player после обрыва.
+func (h *harness) reconnect(player int) {
+	h.fake.reconnects[h.players[player]] <- struct{}{}
+}
+
+// play делает за игрока player первый допустимый ход, не считая пропуска.
+func (h *harness) play(player int) {
+	h.t.Helper()
+	for _, move := range h.g.Session.LegalMoves() {
+		if !move.Pass {
+			move := move
+			h.send(player, &api.PlayMove{Move: &move})
+			return
+		}
+	}
+	h.t.Fatal("нет допустимых ходов")
+}
+
+// illegal отправляет за игрока player недопустимый пропуск хода.
+func (h *harness) illegal(player int) {
+	h.send(player, &api.PlayMove{Move: &game.Move{Pass: true}})
+}
+
+// expect ждёт следующее сообщение сервера и проверяет, что оно адресовано игроку player.
+func (h *harness) expect(player int) sent {
+	h.t.Helper()
+	select {
+	case m := <-h.fake.sent:
+		if m.player != h.players[player] {
+			h.t.Fatalf("сообщение %+v отправлено не игроку %d", m, player)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("игрок %d не получил сообщение", player)
+		return sent{}
+	}
+}
+
+// expectState ждёт состояние партии для игрока player.
+func (h *harness) expectState(player int) *api.StatusUpdate {
+	h.t.Helper()
+	m := h.expect(player)
+	if m.su == nil || m.su.GameState == nil || m.su.GameFinished != nil {
+		h.t.Fatalf("игрок %d получил %+v вместо состояния партии", player, m)
+	}
+	return m.su
+}
+
+// expectDrawOffer ждёт предложение ничьей, переданное игроку player.
+func (h *harness) expectDrawOffer(player int) {
+	h.t.Helper()
+	m := h.expect(player)
+	if m.su == nil || m.su.DrawOffer == nil || m.su.GameState != nil {
+		h.t.Fatalf("игрок %d получил %+v вместо предложения ничьей", player, m)
+	}
+}
+
+// expectFinished ждёт итог партии у обоих игроков и завершения StartGame.
+func (h *harness) expectFinished(reason string, result game.GameResult) {
+	h.t.Helper()
+	for player := range h.players {
+		m := h.expect(player)
+		if m.su == nil || m.su.GameFinished == nil || m.su.GameFinished.Reason != reason {
+			h.t.Fatalf("игрок %d получил %+v, ожидался итог %q", player, m, reason)
+		}
+	}
+	h.wait()
+	if h.g.Session.Result() != result {
+		h.t.Fatalf("результат партии %v, ожидался %v", h.g.Session.Result(), result)
+	}
+}
+
+// wait ждёт завершения StartGame.
+func (h *harness) wait() {
+	h.t.Helper()
+	select {
+	case err := <-h.done:
+		if err != nil {
+			h.t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("партия не завершилась")
+	}
+}
+
+// quiet проверяет, что сервер ничего не отправил игрокам.
+func (h *harness) quiet() {
+	h.t.Helper()
+	select {
+	case m := <-h.fake.sent:
+		h.t.Fatalf("лишнее сообщение %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// lostBy возвращает результат партии, проигранной игроком player.
+func lostBy(player int) game.GameResult {
+	if player == 0 {
+		return game.BlackWon
+	}
+	return game.WhiteWon
+}
+
+func TestIllegalMoves(t *testing.T) {
+	// Шаги сценария: игрок 0 или 1 делает допустимый (ok) или недопустимый (x) ход
+	type step struct {
+		player int
+		legal  bool
+	}
+	x := func(player int) step { return step{player, false} }
+	ok := func(player int) step { return step{player, true} }
+	for _, c := range []struct {
+		name  string
+		limit int
+		steps []step
+		// attemptsLeft — AttemptsLeft в отклонениях по порядку
+		attemptsLeft []int
+		// forfeit — последний недопустимый ход приводит к поражению
+		forfeit bool
+	}{
+		{"без ограничения", 0, []step{x(0), x(0), x(0), x(0), ok(0), x(1)}, []int{-1, -1, -1, -1, -1}, false},
+		{"сброс после хода", 3, []step{x(0), x(0), ok(0), x(1), ok(1), x(0), x(0)}, []int{2, 1, 2, 2, 1}, false},
+		{"поражение", 3, []step{x(0), ok(0), x(1), x(1), x(1)}, []int{2, 2, 1}, true},
+		{"первая же ошибка", 1, []step{ok(0), x(1)}, nil, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := startGame(t, func(s *Server) { s.SetMaxIllegalMoves(c.limit) })
+			h.expectState(0)
+			var attemptsLeft []int
+			for i, step := range c.steps {
+				if step.legal {
+					h.play(step.player)
+					h.expectState(1 - step.player)
+					continue
+				}
+				h.illegal(step.player)
+				if c.forfeit && i == len(c.steps)-1 {
+					h.expectFinished(api.ReasonRulesInfraction, lostBy(step.player))
+					break
+				}
+				m := h.expect(step.player)
+				if m.rejected == nil || m.rejected.Code != "pass_not_allowed" {
+					t.Fatalf("шаг %d: получено %+v вместо отклонения хода", i, m)
+				}
+				attemptsLeft = append(attemptsLeft, m.rejected.AttemptsLeft)
+				// Игрок получает прежнее состояние для повторной попытки
+				h.expectState(step.player)
+			}
+			if fmt.Sprint(attemptsLeft) != fmt.Sprint(c.attemptsLeft) {
+				t.Fatalf("оставшиеся попытки %v, ожидались %v", attemptsLeft, c.attemptsLeft)
+			}
+		})
+	}
+}
+
+func TestMoveOutOfTurn(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+
+	// Ход не в свою очередь отклоняется, но не считается недопустимым
+	h.illegal(1)
+	m := h.expect(1)
+	if m.rejected == nil || m.rejected.Code != "not_your_turn" || m.rejected.AttemptsLeft != DefaultMaxIllegalMoves {
+		t.Fatalf("получено %+v вместо отклонения хода", m)
+	}
+	h.quiet()
+	h.play(0)
+	h.expectState(1)
+}
+
+func TestFlagFall(t *testing.T) {
+	h := startGame(t, func(s *Server) {
+		if err := s.SetTimeControl(game.TimeControl{PerMove: 100 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	su := h.expectState(0)
+	if su.GameState.Clocks == nil || su.GameState.Clocks.Time > 100*time.Millisecond {
+		t.Fatalf("часы в состоянии: %+v", su.GameState.Clocks)
+	}
+	h.play(0)
+	h.expectState(1)
+
+	// Чёрные не ходят, и их флажок падает
+	h.expectFinished(api.ReasonTimeout, game.WhiteWon)
+	if h.g.Record.Termination != record.TerminationTimeForfeit {
+		t.Fatalf("причина в записи %q", h.g.Record.Termination)
+	}
+}
+
+func TestResign(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+
+	// Сдаться можно и в очередь соперника
+	h.send(1, &api.PlayMove{Resign: &api.Resign{}})
+	h.expectFinished(api.ReasonResignation, game.WhiteWon)
+}
+
+func TestDrawAccepted(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+
+	h.send(1, &api.PlayMove{DrawOffer: &api.DrawOffer{}})
+	h.expectDrawOffer(0)
+	h.send(0, &api.PlayMove{DrawReply: &api.DrawReply{Accepted: true}})
+	h.expectFinished(api.ReasonAgreement, game.Draw)
+}
+
+func TestDrawDeclined(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+
+	// Предложивший ничью в свою очередь получает состояние повторно
+	h.send(0, &api.PlayMove{DrawOffer: &api.DrawOffer{}})
+	h.expectDrawOffer(1)
+	h.expectState(0)
+
+	h.send(1, &api.PlayMove{DrawReply: &api.DrawReply{}})
+	m := h.expect(0)
+	if m.su == nil || m.su.DrawReply == nil || m.su.DrawReply.Accepted {
+		t.Fatalf("получено %+v вместо отказа от ничьей", m)
+	}
+	h.quiet()
+	h.play(0)
+	h.expectState(1)
+}
+
+func TestDrawDeclinedByMove(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+
+	h.send(1, &api.PlayMove{DrawOffer: &api.DrawOffer{}})
+	h.expectDrawOffer(0)
+	h.play(0)
+	h.expectState(1)
+
+	// Ход отклонил предложение, и согласие после него ничего не меняет
+	h.send(0, &api.PlayMove{DrawReply: &api.DrawReply{Accepted: true}})
+	h.quiet()
+	h.play(1)
+	h.expectState(0)
+}
+
+func TestAbort(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+	h.play(0)
+	h.expectState(1)
+
+	// Чёрные ещё не ходили и могут прервать партию
+	h.send(1, &api.PlayMove{Abort: &api.Abort{}})
+	h.expectFinished(api.ReasonAborted, game.InProgress)
+}
+
+func TestAbortAfterFirstMove(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	h.expectState(0)
+	h.play(0)
+	h.expectState(1)
+	h.play(1)
+	h.expectState(0)
+
+	h.send(0, &api.PlayMove{Abort: &api.Abort{}})
+	m := h.expect(0)
+	if m.rejected == nil || m.rejected.Code != api.RejectAbortNotAllowed {
+		t.Fatalf("получено %+v вместо отклонения", m)
+	}
+	// Партия продолжается, и белые получают состояние повторно
+	h.expectState(0)
+	h.play(0)
+	h.expectState(1)
+}
+
+func TestReconnectWithinGrace(t *testing.T) {
+	h := startGame(t, func(s *Server) { s.SetReconnectGrace(5 * time.Second) })
+	h.expectState(0)
+	h.send(1, &api.PlayMove{DrawOffer: &api.DrawOffer{}})
+	h.expectDrawOffer(0)
+
+	// Пока белые без связи, партия ждёт их
+	h.drop(0)
+	h.quiet()
+	h.reconnect(0)
+
+	// Вернувшийся игрок получает предложение ничьей и состояние с правилами заново
+	h.expectDrawOffer(0)
+	if su := h.expectState(0); su.Rules == nil {
+		t.Fatal("правила партии не отправлены повторно")
+	}
+	h.play(0)
+	h.expectState(1)
+}
+
+func TestGraceExpired(t *testing.T) {
+	h := startGame(t, func(s *Server) { s.SetReconnectGrace(100 * time.Millisecond) })
+	h.expectState(0)
+	h.play(0)
+	h.expectState(1)
+
+	// Чёрные не вернулись вовремя и проигрывают
+	h.drop(1)
+	h.expectFinished(api.ReasonDisconnect, game.WhiteWon)
+	if h.g.Record.Termination != record.TerminationAbandoned {
+		t.Fatalf("причина в записи %q", h.g.Record.Termination)
+	}
+}
+
+func TestForgedPieces(t *testing.T) {
+	h := startGame(t, func(s *Server) { s.SetMaxIllegalMoves(0) })
+	h.expectState(0)
+	for player, move := range opening[:2] {
+		move := move
+		h.send(player, &api.PlayMove{Move: &move})
+		h.expectState(1 - player)
+	}
+	hash := h.g.Session.Hash()
+
+	// Белые ссылаются на чужие фигуры и на фигуры с подделанным номером
+	for _, c := range []struct {
+		name string
+		move game.Move
+		code string
+	}{
+		{"фигура соперника на доске", place(game.Black, game.QueenBee, 1, -1, 0), "not_your_piece"},
+		{"фигура соперника из руки", place(game.Black, game.SoldierAnt, 1, -1, 0), "not_your_turn"},
+		{"номер не по порядку", place(game.White, game.SoldierAnt, 2, -1, 0), "piece_not_found"},
+		{"номер сверх набора", place(game.White, game.Spider, 3, -1, 0), "piece_not_found"},
+		{"фигура, которой нет в руке", place(game.White, game.QueenBee, 2, -1, 0), "piece_not_in_hand"},
+		{"нулевой номер", place(game.White, game.SoldierAnt, 0, -1, 0), "invalid_move"},
+	} {
+		move := c.move
+		h.send(0, &api.PlayMove{Move: &move})
+		m := h.expect(0)
+		if m.rejected == nil || m.rejected.Code != c.code {
+			t.Fatalf("%s: получено %+v вместо отклонения %q", c.name, m, c.code)
+		}
+		h.expectState(0)
+		if h.g.Session.Hash() != hash || len(h.g.Record.Moves) != 2 {
+			t.Fatalf("%s: отклонённый ход изменил партию", c.name)
+		}
+	}
+	h.play(0)
+	h.expectState(1)
+}
+
+func TestTakebackRequests(t *testing.T) {
+	h := startGame(t, func(s *Server) {})
+	expectRejected := func(player int) {
+		t.Helper()
+		m := h.expect(player)
+		if m.rejected == nil || m.rejected.Code != api.RejectTakebackNotAllowed || m.rejected.AttemptsLeft != -1 {
+			t.Fatalf("получено %+v вместо отклонения запроса", m)
+		}
+	}
+	h.expectState(0)
+
+	// Белым ещё нечего отменять: запрос отклоняется, состояние приходит повторно
+	h.send(0, &api.PlayMove{Takeback: &api.TakebackRequest{}})
+	expectRejected(0)
+	h.expectState(0)
+	h.play(0)
+	h.expectState(1)
+
+	// Пока чёрные думают, белые не могут отменить свой ход
+	h.send(0, &api.PlayMove{Takeback: &api.TakebackRequest{}})
+	expectRejected(0)
+	h.quiet()
+	h.play(1)
+	h.expectState(0)
+
+	// Соперник без поддержки отмены ходов отказывает сразу
+	h.send(0, &api.PlayMove{Takeback: &api.TakebackRequest{}})
+	su := h.expectState(0)
+	if su.TakebackReply == nil || su.TakebackReply.Accepted || len(h.g.Record.Moves) != 2 {
+		t.Fatalf("ответ на запрос %+v, ходов %d", su.TakebackReply, len(h.g.Record.Moves))
+	}
+}
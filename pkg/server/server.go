@@ -2,44 +2,139 @@ package server
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"hive/pkg/api"
 	"hive/pkg/game"
+	"hive/pkg/record"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// transport — связь сервера с игроками. Её реализует api.GameServer.
+type transport interface {
+	Start(ctx context.Context) error
+	GetPlayer(id game.ID) (*api.Player, error)
+	ReceiveMove(player *api.Player, gameID game.ID) (*api.PlayMove, error)
+	AwaitReconnect(player *api.Player, gameID game.ID) error
+	SendStatusUpdate(player *api.Player, su *api.StatusUpdate) error
+	SendMoveRejected(player *api.Player, rejected *api.MoveRejected) error
+}
+
 type Server struct {
 	log *zap.Logger
-	api *api.GameServer
+	api transport
+	// rules — правила партий игроков, не выбравших свой вариант.
+	rules game.Rules
+	// recordDir — каталог для записей завершённых партий; пустая строка
+	// отключает сохранение.
+	recordDir string
+	// maxIllegalMoves — число недопустимых ходов подряд, после которого
+	// игроку засчитывается поражение; 0 снимает ограничение.
+	maxIllegalMoves int
+	// timeControl — контроль времени новых партий.
+	timeControl game.TimeControl
+	// reconnectGrace — сколько партия ждёт возвращения игрока, соединение
+	// с которым потеряно; 0 засчитывает поражение сразу.
+	reconnectGrace time.Duration
 }
 
+const (
+	// DefaultMaxIllegalMoves — ограничение на недопустимые ходы подряд по умолчанию.
+	DefaultMaxIllegalMoves = 3
+	// DefaultReconnectGrace — отсрочка на переподключение по умолчанию.
+	DefaultReconnectGrace = 30 * time.Second
+)
+
 func NewServer(l *zap.Logger, endpoint string) *Server {
 	server := &Server{
-		log: l,
+		log:             l,
+		maxIllegalMoves: DefaultMaxIllegalMoves,
+		reconnectGrace:  DefaultReconnectGrace,
 	}
 	server.api = api.NewGameServer(l, endpoint, server)
 	return server
 }
 
-func (s *Server) Start(ctx context.Context) {
-	s.api.Start(ctx)
+func (s *Server) Start(ctx context.Context) error {
+	return s.api.Start(ctx)
+}
+
+// SetExpansions задаёт расширения, с которыми создаются новые партии,
+// например "MLP". Пустая строка соответствует базовой игре.
+func (s *Server) SetExpansions(expansions string) error {
+	rules := s.rules
+	rules.Expansions = expansions
+	return s.SetRules(rules)
+}
+
+// SetRules задаёт вариант правил для партий игроков, которые при
+// подключении не выбрали свой.
+func (s *Server) SetRules(rules game.Rules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	s.rules = rules
+	return nil
+}
+
+// SetRecordDir задаёт каталог, в который сохраняются записи завершённых партий.
+func (s *Server) SetRecordDir(dir string) {
+	s.recordDir = dir
+}
+
+// SetMaxIllegalMoves задаёт, после скольких недопустимых ходов подряд
+// игроку засчитывается поражение. 0 снимает ограничение.
+func (s *Server) SetMaxIllegalMoves(n int) {
+	s.maxIllegalMoves = n
+}
+
+// SetTimeControl задаёт контроль времени для новых партий. Нулевое
+// значение отключает часы.
+func (s *Server) SetTimeControl(control game.TimeControl) error {
+	if err := control.Validate(); err != nil {
+		return err
+	}
+	s.timeControl = control
+	return nil
+}
+
+// SetReconnectGrace задаёт, сколько партия ждёт возвращения игрока после
+// обрыва соединения. Часы игрока при этом идут. 0 засчитывает поражение сразу.
+func (s *Server) SetReconnectGrace(grace time.Duration) {
+	s.reconnectGrace = grace
 }
 
-func (s *Server) CreateNewGame(first, second *api.Player) *api.Game {
+// CreateNewGame создаёт партию по правилам, выбранным игроками при
+// подключении, или по правилам сервера. Игроки в паре всегда выбирают
+// один и тот же вариант.
+func (s *Server) CreateNewGame(first, second *api.Player) (*api.Game, error) {
 	if rand.Float32() < 0.5 {
 		first, second = second, first
 	}
 
-	game := &api.Game{
-		ID:      game.NewID(),
-		Players: []game.ID{first.ID, second.ID},
-		Session: game.NewGameSession(game.StandardHand),
+	rules := s.rules
+	if first.Rules != nil {
+		rules = *first.Rules
+	}
+	session, err := game.NewGameSessionWithRules(rules)
+	if err != nil {
+		return nil, err
 	}
 
-	return game
+	id := game.NewID()
+	g := &api.Game{
+		ID:      id,
+		Players: []game.ID{first.ID, second.ID},
+		Session: session,
+		Record:  record.New(id, first.ID, second.ID, rules, time.Now()),
+	}
+	if s.timeControl.Enabled() {
+		g.Clock = game.NewClock(s.timeControl)
+	}
+	return g, nil
 }
 
 func (s *Server) StartGame(ctx context.Context, game *api.Game) error {
@@ -52,139 +147,217 @@ func (s *Server) StartGame(ctx context.Context, game *api.Game) error {
 		return err
 	}
 	players := []*api.Player{fp, sp}
-	su := &api.StatusUpdate{
-		GameID:       game.ID,
-		GameState:    &api.GameState{Board: game.Session.GetBoard(), Hand: game.Session.GetWhiteHand(), OpponentHand: game.Session.GetBlackHand()},
-		GameFailed:   nil,
-		GameFinished: nil,
-	}
-	for !game.Session.IsGameOver() {
-		for i := 0; i <= 1; i++ {
-			select {
-			case <-ctx.Done():
-				return nil
+
+	// Сообщения читаются от обоих игроков сразу: сдаться, предложить ничью
+	// или прервать партию можно и в очередь соперника
+	messages := make(chan playerMessage)
+	done := make(chan struct{})
+	defer close(done)
+	for i, player := range players {
+		go s.readMessages(player, game.ID, i, messages, done)
+	}
+
+	l := &gameLoop{game: game, players: players, su: s.StatusUpdate(game), send: true}
+	for !l.over() {
+		if l.send {
+			if err = s.sendTurn(l); err != nil {
+				s.playerLost(l, playerMessage{player: game.Session.GetTurn() % 2, err: err})
+				continue
+			}
+		}
+
+		var flagAt time.Time
+		if game.Clock != nil && game.Clock.Running() {
+			flagAt = game.Clock.Deadline()
+		}
+		flag, stopFlag := timerAt(flagAt)
+		grace, stopGrace := timerAt(l.graceDeadline())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-flag:
+			s.flagFall(l)
+		case <-grace:
+			s.graceExpired(l)
+		case m := <-messages:
+			switch {
+			case m.err != nil:
+				s.playerLost(l, m)
+			case m.reconnected:
+				err = s.resume(l, m.player)
 			default:
-				err = s.api.SendStatusUpdate(players[i], su)
-				if err != nil {
-					s.log.Error("Ошибка при отправке статуса игроку", zap.Error(err))
-					return err
-				}
-
-				if su.GameFailed != nil {
-					s.log.Info(fmt.Sprintf("Ошибка сессии: %s", su.GameFailed.Error))
-				}
-
-				if su.GameFinished != nil {
-					s.log.Info("Игра завершена", zap.Any("id", su.GameID),
-						zap.Bool("tie", su.GameFinished.Tie),
-						zap.Any("winner", su.GameFinished.Winer),
-					)
-				}
-
-				move, err := s.api.ReceiveMove(players[i])
-				if err != nil {
-					s.log.Error("Ошибка при получении хода от игрока", zap.Error(err))
-					return err
-				}
-				// TODO: here server can receive move from different game of same player
-				su, err = s.UpdateGameState(game, move.Move)
-				if err != nil {
-					s.log.Error(err.Error())
-				}
-				su.GameID = move.GameID
-				game.Session.NextTurn()
-				su.GameState.Turn = game.Session.GetTurn()
+				err = s.handleMessage(l, m)
+			}
+			// Игрок, до которого сообщение не дошло, потерял соединение:
+			// партия дождётся его возвращения и отправит нужное заново
+			if err != nil {
+				s.log.Error("Ошибка при отправке статуса игроку", zap.Error(err))
 			}
 		}
+		stopFlag()
+		stopGrace()
 	}
-	return nil
+	return s.FinishGame(game, players, l.reason)
 }
 
-func (s *Server) UpdateGameState(g *api.Game, move *game.Move) (*api.StatusUpdate, error) {
-	// TODO: Check if move correct'
-	var su *api.StatusUpdate
-	if !move.Piece.Placed {
-		color := game.White
-		if !g.Session.WhiteToMove() {
-			color = game.Black
+// FinishGame рассылает обоим игрокам итог партии и сохраняет её запись.
+// Первый игрок в списке всегда играет белыми. Пустая причина reason
+// означает, что партия решилась на доске. Отключившийся игрок получит
+// итог, когда подключится заново.
+func (s *Server) FinishGame(g *api.Game, players []*api.Player, reason string) error {
+	if reason == "" {
+		reason = boardReason(g.Session)
+	}
+	result := g.Session.Result()
+	var winner *api.Winner
+	for i, color := range []game.PieceColor{game.White, game.Black} {
+		if result.Won(color) {
+			winner = &api.Winner{Color: color, PlayerID: players[i].ID}
 		}
+	}
 
-		availablePositions := game.AvailableToPlace(g.Session.GetBoard(), color)
-		positionLegal := false
-
-		for _, position := range availablePositions {
-			if move.Position.X == position.X && move.Position.Y == position.Y {
-				positionLegal = true
-				break
-			}
+	var sendErr error
+	for i, player := range players {
+		color := colorOf(i)
+		su := &api.StatusUpdate{
+			GameID:    g.ID,
+			GameState: gameState(g, color),
+			GameFinished: &api.GameFinished{
+				Winer:     result.Won(color),
+				Tie:       result == game.Draw,
+				Reason:    reason,
+				Winner:    winner,
+				Board:     g.Session.GetBoard(),
+				MoveCount: len(g.Record.Moves),
+				Moves:     g.Record.Moves,
+			},
 		}
-
-		if positionLegal {
-			var hand *game.Hand
-			if g.Session.WhiteToMove() {
-				hand = g.Session.GetWhiteHand()
-			} else {
-				hand = g.Session.GetBlackHand()
-			}
-
-			if hand.Pieces[move.Piece.Type] > 0 {
-				if g.Session.GetTurn() >= 6 && hand.Pieces[game.QueenBee] != 0 {
-					if move.Piece.Type != game.QueenBee {
-						return nil, errors.New("королеву улья нужно разместить за 4 хода")
-					}
-				}
-				piece := move.Piece
-				piece.Placed = true
-				piece.Position = *move.Position
-				g.Session.GetBoard().Pieces = append(g.Session.GetBoard().Pieces, move.Piece)
-				hand.Pieces[move.Piece.Type] -= 1
-			} else {
-				return nil, fmt.Errorf("недостаточно насекомых типа %T", move.Piece.Type)
+		if err := s.api.SendStatusUpdate(player, su); err != nil {
+			s.log.Error("Ошибка при отправке статуса игроку", zap.Error(err))
+			if sendErr == nil {
+				sendErr = err
 			}
 		}
-	} else {
-		availablePositions := game.AvailableToMove(g.Session.GetBoard(), move.Piece)
-		positionLegal := false
-		for _, pos := range availablePositions {
-			if move.Position.X == pos.X && move.Position.Y == pos.Y {
-				positionLegal = true
-				break
-			}
+	}
+
+	s.log.Info("Игра завершена", zap.Any("id", g.ID),
+		zap.Stringer("result", result),
+		zap.String("reason", reason),
+		zap.Int("moves", len(g.Record.Moves)),
+	)
+	// Прерванная партия не сыграна, и её запись не сохраняется
+	if s.recordDir != "" && reason != api.ReasonAborted {
+		if err := s.SaveRecord(g); err != nil {
+			s.log.Error("Ошибка при сохранении записи партии", zap.Error(err))
 		}
+	}
+	return sendErr
+}
 
-		if positionLegal {
-			var hand *game.Hand
-			if g.Session.WhiteToMove() {
-				hand = g.Session.GetWhiteHand()
-			} else {
-				hand = g.Session.GetBlackHand()
-			}
+// boardReason возвращает причину завершения партии, решённой на доске.
+func boardReason(session *game.GameSession) string {
+	switch {
+	case session.Result() != game.Draw:
+		return api.ReasonQueenSurrounded
+	case session.QueenSurrounded(game.White) && session.QueenSurrounded(game.Black):
+		return api.ReasonBothSurrounded
+	case session.Repetitions() >= 3:
+		return api.ReasonRepetition
+	default:
+		// Иначе ничья наступает только по соглашению игроков
+		return api.ReasonAgreement
+	}
+}
 
-			if g.Session.GetTurn() >= 6 && hand.Pieces[game.QueenBee] != 0 {
-				return nil, errors.New("королеву улья нужно разместить за 4 хода")
-			}
+// SaveRecord сохраняет запись партии в каталог записей под путём,
+// построенным по идентификатору партии.
+func (s *Server) SaveRecord(g *api.Game) error {
+	path := filepath.Join(s.recordDir, g.ID.Path()+".hive")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = g.Record.Encode(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-			s.log.Info("", zap.Any("board", g.Session.GetBoard().Pieces))
+func (s *Server) UpdateGameState(g *api.Game, move *game.Move) (*api.StatusUpdate, error) {
+	if err := g.Record.Play(g.Session, move); err != nil {
+		return nil, err
+	}
+	if g.Clock != nil {
+		g.Clock.Stop(time.Now())
+	}
+	s.log.Info("Ход сделан", zap.Any("id", g.ID), zap.String("move", g.Record.Moves[len(g.Record.Moves)-1]))
+	return s.StatusUpdate(g), nil
+}
 
-			for _, pos := range g.Session.GetBoard().Pieces {
-				if move.Piece.Position.X == pos.Position.X && move.Piece.Position.Y == pos.Position.Y {
-					s.log.Info("HELLO")
-					(*pos).Position = game.Position{X: move.Position.X, Y: move.Position.Y}
-					break
-				}
-			}
+// MoveRejected собирает ответ на недопустимый ход move, сделанный
+// attempts раз подряд.
+func (s *Server) MoveRejected(g *api.Game, move *api.PlayMove, err error, attempts int) *api.MoveRejected {
+	attemptsLeft := -1
+	if s.maxIllegalMoves > 0 {
+		attemptsLeft = s.maxIllegalMoves - attempts
+	}
+	return &api.MoveRejected{
+		GameID:       g.ID,
+		Move:         move.Move,
+		Code:         api.RejectionCode(err),
+		Message:      err.Error(),
+		AttemptsLeft: attemptsLeft,
+	}
+}
 
-			s.log.Info("", zap.Any("board", g.Session.GetBoard().Pieces))
+// Takeback применяет ответ соперника на запрос отмены хода и возвращает
+// состояние для запросившего игрока с этим ответом. При согласии
+// отменяются два полухода: ход запросившего игрока и ответ соперника.
+func (s *Server) Takeback(g *api.Game, accepted bool) (*api.StatusUpdate, error) {
+	if accepted {
+		for i := 0; i < 2; i++ {
+			if err := g.Record.Undo(g.Session); err != nil {
+				return nil, err
+			}
 		}
 	}
-	su = &api.StatusUpdate{GameState: &api.GameState{}}
-	su.GameState.Board = g.Session.GetBoard()
-	if g.Session.WhiteToMove() {
-		su.GameState.Hand = g.Session.GetBlackHand()
-		su.GameState.OpponentHand = g.Session.GetWhiteHand()
-	} else {
-		su.GameState.Hand = g.Session.GetWhiteHand()
-		su.GameState.OpponentHand = g.Session.GetBlackHand()
-	}
+
+	s.log.Info("Запрос отмены хода", zap.Any("id", g.ID), zap.Bool("accepted", accepted))
+	su := s.StatusUpdate(g)
+	su.TakebackReply = &api.TakebackReply{Accepted: accepted}
 	return su, nil
 }
+
+// StatusUpdate собирает состояние партии с точки зрения игрока, чья сейчас очередь.
+func (s *Server) StatusUpdate(g *api.Game) *api.StatusUpdate {
+	return &api.StatusUpdate{
+		GameID:    g.ID,
+		GameState: gameState(g, g.Session.ColorToMove()),
+	}
+}
+
+func gameState(g *api.Game, color game.PieceColor) *api.GameState {
+	return &api.GameState{
+		Board:        g.Session.GetBoard(),
+		Hand:         g.Session.GetHand(color),
+		OpponentHand: g.Session.GetHand(color.Opponent()),
+		Turn:         g.Session.GetTurn(),
+		Clocks:       clocks(g, color),
+		LastMoved:    g.Session.LastMoved(),
+	}
+}
+
+func clocks(g *api.Game, color game.PieceColor) *api.Clocks {
+	if g.Clock == nil {
+		return nil
+	}
+	now := time.Now()
+	return &api.Clocks{
+		Time:         g.Clock.Remaining(color, now),
+		OpponentTime: g.Clock.Remaining(color.Opponent(), now),
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"hive/pkg/api"
+	"hive/pkg/game"
+	"hive/pkg/record"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newGame создаёт партию сервера s и играет в ней ходы moves.
+func newGame(t *testing.T, s *Server, moves ...game.Move) *api.Game {
+	t.Helper()
+	g, err := s.CreateNewGame(&api.Player{ID: game.NewID()}, &api.Player{ID: game.NewID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, move := range moves {
+		move := move
+		if err = g.Record.Play(g.Session, &move); err != nil {
+			t.Fatalf("ход %+v: %v", move, err)
+		}
+	}
+	return g
+}
+
+func place(color game.PieceColor, pieceType game.PieceType, number, x, y int) game.Move {
+	return game.Move{Piece: game.PieceID{Color: color, Type: pieceType, Number: number}, Position: &game.Position{X: x, Y: y}}
+}
+
+var opening = []game.Move{
+	place(game.White, game.QueenBee, 1, 0, 0),
+	place(game.Black, game.QueenBee, 1, 1, 0),
+	place(game.White, game.SoldierAnt, 1, -1, 0),
+}
+
+func TestTakeback(t *testing.T) {
+	s := NewServer(zap.NewNop(), "")
+	g := newGame(t, s, opening...)
+	hash := g.Session.Hash()
+
+	su, err := s.Takeback(g, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if su.TakebackReply == nil || su.TakebackReply.Accepted || g.Session.Hash() != hash || len(g.Record.Moves) != 3 {
+		t.Fatalf("отказ изменил партию: %+v", su.TakebackReply)
+	}
+
+	// Чёрные запросили отмену своего хода: отменяются он и ответ белых
+	su, err = s.Takeback(g, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !su.TakebackReply.Accepted || su.GameState.Turn != 1 || g.Session.ColorToMove() != game.Black {
+		t.Fatalf("после отмены ход %d", su.GameState.Turn)
+	}
+	if !reflect.DeepEqual(g.Record.Moves, []string{"wQ"}) || len(g.Session.History()) != 1 {
+		t.Fatalf("после отмены записаны ходы %q", g.Record.Moves)
+	}
+	if g.Session.GetHand(game.Black).Pieces[game.QueenBee] != 1 || g.Session.GetBoard().Piece(opening[2].Piece) != nil {
+		t.Fatal("отменённые фигуры не вернулись в руки")
+	}
+
+	if _, err = s.Takeback(g, true); err == nil {
+		t.Fatal("отменены ходы, которых нет")
+	}
+}
+
+// finish завершает партию g с причиной reason и возвращает итоги,
+// отправленные её игрокам, по номерам игроков.
+func finish(t *testing.T, s *Server, g *api.Game, reason string) map[int]*api.GameFinished {
+	t.Helper()
+	fake := newFakeTransport()
+	s.api = fake
+	players := []*api.Player{{ID: g.Players[0]}, {ID: g.Players[1]}}
+	if err := s.FinishGame(g, players, reason); err != nil {
+		t.Fatal(err)
+	}
+	close(fake.sent)
+	finished := map[int]*api.GameFinished{}
+	for m := range fake.sent {
+		for i, player := range players {
+			if m.player == player && m.su != nil && m.su.GameFinished != nil {
+				finished[i] = m.su.GameFinished
+			}
+		}
+	}
+	return finished
+}
+
+func TestFinishGame(t *testing.T) {
+	s := NewServer(zap.NewNop(), "")
+	white, black := &api.Player{ID: game.NewID()}, &api.Player{ID: game.NewID()}
+	g, err := s.CreateNewGame(white, black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Игроки меняются местами случайно, но первый в партии всегда играет белыми
+	if g.Players[0] == black.ID {
+		white, black = black, white
+	}
+	if g.Record.White != white.ID || g.Record.Black != black.ID {
+		t.Fatal("цвета в записи не совпадают с порядком игроков")
+	}
+	for _, move := range opening {
+		move := move
+		if err = g.Record.Play(g.Session, &move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.Record.Forfeit(g.Session, game.Black, record.TerminationResignation)
+
+	finished := finish(t, s, g, api.ReasonResignation)
+	if len(finished) != 2 {
+		t.Fatalf("итог получили %d игроков", len(finished))
+	}
+	for i, f := range finished {
+		if f.Reason != api.ReasonResignation || f.Tie || f.Winer != (i == 0) {
+			t.Fatalf("игрок %d получил итог %+v", i, f)
+		}
+		if f.Winner == nil || f.Winner.Color != game.White || f.Winner.PlayerID != white.ID {
+			t.Fatalf("победитель %+v, ожидались белые %v", f.Winner, white.ID)
+		}
+		if f.MoveCount != 3 || !reflect.DeepEqual(f.Moves, g.Record.Moves) {
+			t.Fatalf("в итоге %d ходов %q", f.MoveCount, f.Moves)
+		}
+	}
+}
+
+func TestFinishGameDisconnect(t *testing.T) {
+	s := NewServer(zap.NewNop(), "")
+	g := newGame(t, s, opening...)
+	g.Record.Forfeit(g.Session, game.White, record.TerminationAbandoned)
+
+	// Итог отправляется и отключившемуся игроку: транспорт доставит его,
+	// когда игрок вернётся
+	finished := finish(t, s, g, api.ReasonDisconnect)
+	if len(finished) != 2 || finished[0].Winer || !finished[1].Winer || finished[0].Reason != api.ReasonDisconnect {
+		t.Fatalf("итоги %+v", finished)
+	}
+}
+
+func TestBoardReason(t *testing.T) {
+	s := NewServer(zap.NewNop(), "")
+	// Муравьи уходят из исходных клеток и возвращаются, повторяя позицию
+	moves := append(opening[:3:3], place(game.Black, game.SoldierAnt, 1, 2, 0))
+	for i := 0; i < 2; i++ {
+		moves = append(moves,
+			place(game.White, game.SoldierAnt, 1, 0, -1),
+			place(game.Black, game.SoldierAnt, 1, 2, 1),
+			place(game.White, game.SoldierAnt, 1, -1, 0),
+			place(game.Black, game.SoldierAnt, 1, 2, 0),
+		)
+	}
+	g := newGame(t, s, moves...)
+	if g.Session.Result() != game.Draw {
+		t.Fatalf("результат %v после трёх повторений", g.Session.Result())
+	}
+	finished := finish(t, s, g, "")
+	if f := finished[0]; f == nil || f.Reason != api.ReasonRepetition || !f.Tie || f.Winner != nil || f.MoveCount != 12 {
+		t.Fatalf("итог %+v", f)
+	}
+
+	g = newGame(t, s, opening...)
+	g.Record.AgreeDraw(g.Session)
+	if reason := boardReason(g.Session); reason != api.ReasonAgreement {
+		t.Fatalf("причина ничьей по соглашению %q", reason)
+	}
+}
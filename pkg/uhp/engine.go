@@ -0,0 +1,282 @@
+package uhp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hive/pkg/client"
+	"hive/pkg/game"
+	"hive/pkg/notation"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var _ = client.Engine(&Engine{})
+
+type state struct {
+	board        *game.Board
+	hand         *game.Hand
+	opponentHand *game.Hand
+	turn         int
+}
+
+// Engine реализует client.Engine, передавая выбор хода внешнему движку
+// Universal Hive Protocol (например, Mzinga или nokamute), запущенному
+// как отдельный процесс.
+type Engine struct {
+	log      *zap.Logger
+	command  string
+	args     []string
+	moveTime time.Duration
+	rules    game.Rules
+	stdin    io.Writer
+	stdout   *bufio.Reader
+	session  *game.GameSession
+	updates  chan state
+}
+
+func NewEngine(logger *zap.Logger, moveTime time.Duration, command string, args ...string) *Engine {
+	return &Engine{
+		log:      logger,
+		command:  command,
+		args:     args,
+		moveTime: moveTime,
+		updates:  make(chan state, 1),
+	}
+}
+
+func (e *Engine) Start(ctx context.Context, rules game.Rules, board *game.Board, hand, opponentHand *game.Hand, turn int, engineResponse chan *game.Move) {
+	e.rules = rules
+	cmd := exec.CommandContext(ctx, e.command, e.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		e.log.Error("Ошибка запуска движка UHP", zap.Error(err))
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		e.log.Error("Ошибка запуска движка UHP", zap.Error(err))
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		e.log.Error("Ошибка запуска движка UHP", zap.Error(err))
+		return
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	e.stdin = stdin
+	e.stdout = bufio.NewReader(stdout)
+	info, err := e.readResponse()
+	if err != nil {
+		e.log.Error("Ошибка запуска движка UHP", zap.Error(err))
+		return
+	}
+	e.log.Info("Движок UHP запущен", zap.Strings("info", info))
+
+	current := state{board: board, hand: hand, opponentHand: opponentHand, turn: turn}
+	for {
+		move, err := e.play(current)
+		if err != nil {
+			e.log.Error("Ошибка движка UHP", zap.Error(err))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case engineResponse <- move:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case current = <-e.updates:
+		}
+	}
+}
+
+// Update передаёт движку новое состояние. Непрочитанное прежнее состояние
+// заменяется: движку нужна только последняя позиция, а после остановки
+// Start вызов не блокируется.
+func (e *Engine) Update(board *game.Board, hand, opponentHand *game.Hand, turn int) {
+	current := state{board: board, hand: hand, opponentHand: opponentHand, turn: turn}
+	for {
+		select {
+		case e.updates <- current:
+			return
+		default:
+		}
+		select {
+		case <-e.updates:
+		default:
+		}
+	}
+}
+
+// play догоняет полученное от сервера состояние и запрашивает у движка лучший ход.
+func (e *Engine) play(current state) (*game.Move, error) {
+	if e.session == nil {
+		// Внешний движок играет по стандартным правилам. Турнирное правило
+		// и ограничения первого хода только сужают выбор, и неподходящий
+		// ход движка считается ошибкой ниже, а более поздний срок
+		// выставления королевы движок не примет
+		if e.rules.Deadline() > game.DefaultQueenDeadline {
+			return nil, errors.New("движок UHP не поддерживает выставление королевы улья позже четвёртого хода")
+		}
+		session, err := game.NewGameSessionWithRules(e.rules)
+		if err != nil {
+			return nil, err
+		}
+		gameType := notation.FormatRules(game.Rules{Expansions: e.rules.Expansions})
+		if _, err = e.send("newgame " + gameType); err != nil {
+			return nil, err
+		}
+		e.session = session
+	}
+
+	// После отмены ходов сервером или отклонённого хода партия движка может
+	// оказаться впереди или разойтись с полученной позицией: лишние ходы отменяются
+	for e.session.GetTurn() > current.turn {
+		if err := e.undo(); err != nil {
+			return nil, err
+		}
+	}
+	for e.session.GetTurn() < current.turn || !sameBoard(e.session.GetBoard(), current.board) {
+		if e.session.GetTurn() < current.turn {
+			move, err := e.findMove(current.board)
+			if err == nil {
+				if err = e.playMove(move); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		if err := e.undo(); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := e.send("bestmove time " + formatDuration(e.moveTime))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) != 1 {
+		return nil, fmt.Errorf("неожиданный ответ движка на bestmove: %q", response)
+	}
+	move, err := notation.ParseMove(e.session, response[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = e.session.ValidateMove(move); err != nil {
+		return nil, fmt.Errorf("ход движка %q нарушает правила партии: %w", response[0], err)
+	}
+	if err = e.playMove(move); err != nil {
+		return nil, err
+	}
+	return move, nil
+}
+
+func (e *Engine) playMove(move *game.Move) error {
+	played, err := notation.FormatMove(e.session, move)
+	if err != nil {
+		return err
+	}
+	if _, err = e.send("play " + played); err != nil {
+		return err
+	}
+	return e.session.ApplyMove(move)
+}
+
+func (e *Engine) undo() error {
+	if err := e.session.Undo(); err != nil {
+		return errors.New("не удалось восстановить ход соперника")
+	}
+	_, err := e.send("undo")
+	return err
+}
+
+// findMove находит ход соперника, после которого доска партии совпадает с board.
+func (e *Engine) findMove(board *game.Board) (*game.Move, error) {
+	for _, move := range e.session.LegalMoves() {
+		move := move
+		next := e.session.Clone()
+		if err := next.ApplyMove(&move); err != nil {
+			continue
+		}
+		if sameBoard(next.GetBoard(), board) {
+			return &move, nil
+		}
+	}
+	return nil, errors.New("не удалось восстановить ход соперника")
+}
+
+// send отправляет команду движку и возвращает строки ответа без завершающего ok.
+func (e *Engine) send(command string) ([]string, error) {
+	e.log.Debug("UHP >", zap.String("command", command))
+	if _, err := io.WriteString(e.stdin, command+"\n"); err != nil {
+		return nil, err
+	}
+	response, err := e.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range response {
+		if strings.HasPrefix(line, "err") || strings.HasPrefix(line, "invalidmove") {
+			return nil, fmt.Errorf("движок отклонил команду %q: %s", command, line)
+		}
+	}
+	return response, nil
+}
+
+func (e *Engine) readResponse() ([]string, error) {
+	var lines []string
+	for {
+		line, err := e.stdout.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "ok" {
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func sameBoard(lhs, rhs *game.Board) bool {
+	type key struct {
+		position game.Position
+		level    int
+		kind     game.PieceType
+		color    game.PieceColor
+	}
+	if len(lhs.Pieces) != len(rhs.Pieces) {
+		return false
+	}
+	pieces := map[key]int{}
+	for _, piece := range lhs.Pieces {
+		pieces[key{piece.Position, piece.Level, piece.Type, piece.Color}] += 1
+	}
+	for _, piece := range rhs.Pieces {
+		k := key{piece.Position, piece.Level, piece.Type, piece.Color}
+		if pieces[k] == 0 {
+			return false
+		}
+		pieces[k] -= 1
+	}
+	return true
+}
+
+// formatDuration записывает время на ход в формате чч:мм:сс. Доли секунды
+// округляются вверх, чтобы движку не досталось нулевое время.
+func formatDuration(d time.Duration) string {
+	seconds := int((d + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
@@ -0,0 +1,149 @@
+package uhp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hive/pkg/game"
+	"hive/pkg/notation"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeEngineEnv передаёт процессу фальшивого движка ходы, которые он
+// по очереди возвращает на bestmove.
+const fakeEngineEnv = "HIVE_FAKE_UHP_MOVES"
+
+// TestFakeEngine выполняется в дочернем процессе и играет роль движка UHP.
+func TestFakeEngine(t *testing.T) {
+	script, ok := os.LookupEnv(fakeEngineEnv)
+	if !ok {
+		t.Skip("запускается только как движок для TestEngine")
+	}
+	moves := strings.Split(script, ",")
+	in := bufio.NewScanner(os.Stdin)
+	fmt.Println("id Fake\nok")
+	for in.Scan() {
+		command := strings.Fields(in.Text())
+		if len(command) > 0 && command[0] == "bestmove" {
+			fmt.Println(moves[0])
+			moves = moves[1:]
+		}
+		fmt.Println("ok")
+	}
+	os.Exit(0)
+}
+
+// fakeEngine запускает текущий тестовый бинарник как движок, отвечающий ходами moves.
+func fakeEngine(t *testing.T, log *zap.Logger, moves ...string) *Engine {
+	t.Setenv(fakeEngineEnv, strings.Join(moves, ","))
+	return NewEngine(log, 500*time.Millisecond, os.Args[0], "-test.run=^TestFakeEngine$")
+}
+
+func TestEngine(t *testing.T) {
+	// Партия, которую сервер видит со стороны белых: ход белых, ответ
+	// чёрных, снова ход белых
+	session := game.NewGameSession(game.StandardHand)
+	moves := []game.Move{
+		{Piece: game.PieceID{Color: game.White, Type: game.QueenBee, Number: 1}, Position: &game.Position{X: 0, Y: 0}},
+		{Piece: game.PieceID{Color: game.Black, Type: game.QueenBee, Number: 1}, Position: &game.Position{X: 1, Y: 0}},
+		{Piece: game.PieceID{Color: game.White, Type: game.SoldierAnt, Number: 1}, Position: &game.Position{X: -1, Y: 0}},
+	}
+	var script []string
+	states := make([]*game.GameSession, len(moves))
+	for i := range moves {
+		states[i] = session.Clone()
+		formatted, err := notation.FormatMove(session, &moves[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			script = append(script, formatted)
+		}
+		if err = session.ApplyMove(&moves[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine := fakeEngine(t, zap.NewNop(), script...)
+	responses := make(chan *game.Move)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		first := states[0]
+		engine.Start(ctx, game.Rules{}, first.GetBoard(), first.GetWhiteHand(), first.GetBlackHand(), first.GetTurn(), responses)
+	}()
+
+	for _, i := range []int{0, 2} {
+		if i > 0 {
+			state := states[i]
+			engine.Update(state.GetBoard(), state.GetWhiteHand(), state.GetBlackHand(), state.GetTurn())
+		}
+		select {
+		case move := <-responses:
+			if move.Piece != moves[i].Piece || *move.Position != *moves[i].Position {
+				t.Fatalf("ход %d: получен %+v, ожидался %+v", i, *move, moves[i])
+			}
+		case <-done:
+			t.Fatalf("движок остановился до хода %d", i)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("движок не сделал ход %d", i)
+		}
+	}
+
+	cancel()
+	<-done
+	// После остановки Start обновления не блокируются
+	for i := 0; i < 3; i++ {
+		engine.Update(states[0].GetBoard(), states[0].GetWhiteHand(), states[0].GetBlackHand(), 0)
+	}
+}
+
+func TestEngineIllegalMove(t *testing.T) {
+	// Первым ходом белых движок предлагает выставить чёрную королеву
+	core, logs := observer.New(zap.ErrorLevel)
+	engine := fakeEngine(t, zap.New(core), "bQ")
+	session := game.NewGameSession(game.StandardHand)
+	responses := make(chan *game.Move, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		engine.Start(context.Background(), game.Rules{}, session.GetBoard(), session.GetWhiteHand(), session.GetBlackHand(), 0, responses)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("движок не остановился после недопустимого хода")
+	}
+	if len(responses) > 0 {
+		t.Fatalf("недопустимый ход передан серверу: %+v", *<-responses)
+	}
+	if logs.FilterMessage("Ошибка движка UHP").Len() != 1 {
+		t.Fatalf("ошибка не записана в журнал: %v", logs.All())
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00:00"},
+		{300 * time.Millisecond, "00:00:01"},
+		{time.Second, "00:00:01"},
+		{90 * time.Second, "00:01:30"},
+		{time.Hour + 200*time.Millisecond, "01:00:01"},
+	} {
+		if got := formatDuration(c.d); got != c.want {
+			t.Errorf("formatDuration(%v) = %s, ожидалось %s", c.d, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package uhp
+
+import (
+	"hive/pkg/game"
+	"math"
+)
+
+const winScore = 1000
+
+// bestMove выбирает ход жадной оценкой позиции на один полуход вперёд:
+// сначала победа, затем наибольшее окружение королевы соперника при
+// наименьшем окружении своей.
+func bestMove(session *game.GameSession) *game.Move {
+	moves := session.LegalMoves()
+	if len(moves) == 0 {
+		return nil
+	}
+
+	color := session.ColorToMove()
+	best, bestScore := 0, math.MinInt
+	for i := range moves {
+		next := session.Clone()
+		if err := next.ApplyMove(&moves[i]); err != nil {
+			continue
+		}
+		if score := evaluate(next, color); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return &moves[best]
+}
+
+func evaluate(session *game.GameSession, color game.PieceColor) int {
+	opponent := color.Opponent()
+	switch result := session.Result(); {
+	case result.Won(color):
+		return winScore
+	case result.Won(opponent):
+		return -winScore
+	case result == game.Draw:
+		return 0
+	}
+	return queenPressure(session.GetBoard(), opponent) - queenPressure(session.GetBoard(), color)
+}
+
+// queenPressure возвращает число занятых клеток вокруг королевы улья цвета color.
+func queenPressure(board *game.Board, color game.PieceColor) int {
+	for _, piece := range board.Pieces {
+		if piece.Type != game.QueenBee || piece.Color != color {
+			continue
+		}
+		pressure := 0
+		for _, position := range game.Neighbours(piece.Position) {
+			if board.TopPiece(position) != nil {
+				pressure += 1
+			}
+		}
+		return pressure
+	}
+	return 0
+}
@@ -0,0 +1,190 @@
+package uhp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hive/pkg/game"
+	"hive/pkg/notation"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const engineID = "id Hive v0.1"
+
+var errNoGame = errors.New("партия не начата, используйте newgame")
+
+// Server реализует движок Universal Hive Protocol поверх правил пакета game,
+// чтобы сторонние интерфейсы могли играть против него.
+type Server struct {
+	in       *bufio.Scanner
+	out      io.Writer
+	session  *game.GameSession
+	moves    []string
+	gameType string
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:  bufio.NewScanner(in),
+		out: out,
+	}
+}
+
+// Serve обрабатывает команды UHP до конца входного потока или команды exit.
+func (s *Server) Serve() error {
+	if err := s.respond(engineID + "\n" + capabilities()); err != nil {
+		return err
+	}
+	for s.in.Scan() {
+		line := strings.TrimSpace(s.in.Text())
+		if line == "" {
+			continue
+		}
+		if line == "exit" {
+			return nil
+		}
+		if err := s.respond(s.handle(line)); err != nil {
+			return err
+		}
+	}
+	return s.in.Err()
+}
+
+func (s *Server) respond(response string) error {
+	if response != "" {
+		response += "\n"
+	}
+	_, err := io.WriteString(s.out, response+"ok\n")
+	return err
+}
+
+func (s *Server) handle(line string) string {
+	command, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+
+	switch command {
+	case "info":
+		return engineID + "\n" + capabilities()
+	case "options":
+		return ""
+	case "newgame":
+		return s.newGame(args)
+	case "play":
+		return s.play(args)
+	case "pass":
+		return s.play("pass")
+	case "undo":
+		return s.undo(args)
+	case "validmoves":
+		if s.session == nil {
+			return "err " + errNoGame.Error()
+		}
+		var moves []string
+		for _, move := range s.session.LegalMoves() {
+			move := move
+			formatted, err := notation.FormatMove(s.session, &move)
+			if err != nil {
+				return "err " + err.Error()
+			}
+			moves = append(moves, formatted)
+		}
+		return strings.Join(moves, ";")
+	case "bestmove":
+		if s.session == nil {
+			return "err " + errNoGame.Error()
+		}
+		move := bestMove(s.session)
+		if move == nil {
+			return "err " + game.ErrGameOver.Error()
+		}
+		formatted, err := notation.FormatMove(s.session, move)
+		if err != nil {
+			return "err " + err.Error()
+		}
+		return formatted
+	default:
+		return fmt.Sprintf("err неизвестная команда %q", command)
+	}
+}
+
+// newGame начинает партию по строке типа игры или по полной строке партии
+// вида "Base+M;InProgress;White[2];wS1;bG1 -wS1".
+func (s *Server) newGame(args string) string {
+	if args == "" {
+		args = "Base"
+	}
+	session, moves, err := notation.ParseGameString(args)
+	if err != nil {
+		s.session = nil
+		return "err " + err.Error()
+	}
+
+	s.session = session
+	s.moves = moves
+	s.gameType = notation.FormatRules(session.Rules())
+	return s.gameString()
+}
+
+func (s *Server) play(move string) string {
+	if s.session == nil {
+		return "err " + errNoGame.Error()
+	}
+	if err := s.apply(move); err != nil {
+		return "invalidmove " + err.Error()
+	}
+	return s.gameString()
+}
+
+// undo отменяет указанное число последних ходов, по умолчанию один.
+func (s *Server) undo(args string) string {
+	if s.session == nil {
+		return "err " + errNoGame.Error()
+	}
+	count := 1
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 {
+			return fmt.Sprintf("err некорректное число ходов %q", args)
+		}
+		count = n
+	}
+	if count > len(s.moves) {
+		return "err " + game.ErrNothingToUndo.Error()
+	}
+	for i := 0; i < count; i++ {
+		if err := s.session.Undo(); err != nil {
+			return "err " + err.Error()
+		}
+	}
+	s.moves = s.moves[:len(s.moves)-count]
+	return s.gameString()
+}
+
+// apply разбирает ход, применяет его к партии и записывает в историю
+// в нормализованном виде.
+func (s *Server) apply(move string) error {
+	parsed, err := notation.ParseMove(s.session, move)
+	if err != nil {
+		return err
+	}
+	normalized, err := notation.FormatMove(s.session, parsed)
+	if err != nil {
+		return err
+	}
+	if err = s.session.ApplyMove(parsed); err != nil {
+		return err
+	}
+	s.moves = append(s.moves, normalized)
+	return nil
+}
+
+// gameString возвращает строку партии UHP: тип игры, состояние, очередь хода и ходы.
+func (s *Server) gameString() string {
+	return notation.GameString(s.gameType, s.session, s.moves)
+}
+
+func capabilities() string {
+	return "Mosquito;Ladybug;Pillbug"
+}